@@ -1,21 +1,28 @@
 package action
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
-
-	"gopkg.in/ini.v1"
+	"sync"
+	texttemplate "text/template"
+	"time"
+	"unicode"
 
 	"onplugd/deviceevent"
 	"onplugd/executor"
+	"onplugd/utils"
 )
 
 // Action is an IAction implementation where the details of the action are
-// stored in an INI file.
+// stored in a config file.
 type Action struct {
-	name string
+	label string
+	name  string
 
 	events     []string
 	paths      []string
@@ -25,135 +32,915 @@ type Action struct {
 	attrs      map[string][]string
 	uevents    map[string][]string
 
-	execs []string
+	execs       []string
+	argvs       []argv
+	scripts     []string
+	interpreter []string
+	// The exec lines that are templates, parsed.
+	templates map[string]*texttemplate.Template
+	// Where each exec line and script is defined, for error messages.
+	origins map[string]string
+	// The exec lines, argv values and scripts, in the order of the config.
+	steps []step
+
+	stdin     string
+	mode      string
+	onError   string
+	timeout   time.Duration
+	killAfter time.Duration
+	retry     executor.RetryPolicy
+	// The working directory of the commands, "/" if empty.
+	workdir string
+	// The NAME=value variables added to the environment of the commands.
+	env      []string
+	cleanEnv bool
+	// Who the commands run as, nil for the daemon's user.
+	credential *executor.Credential
+
+	priority int
+	final    bool
+	// Its concurrency policy, and the lock it holds while running, if any.
+	concurrency string
+	lock        string
+	// How long it doesn't run again for the same device, and how many times
+	// it runs at most per period.
+	cooldown   time.Duration
+	rateLimit  int
+	ratePeriod time.Duration
+	// How long after the event it runs.
+	delay time.Duration
+	// The command kept running while the devices it matches are present.
+	whilePresent string
+
+	warnings []Diagnostic
 }
 
 // Match checks if a given IDeviceEvent matches this action.
 func (a *Action) Match(event deviceevent.IDeviceEvent) bool {
+	return a.Explain(event).Matched()
+}
 
-	if !foundIn(string(event.Event()), a.events) {
-		return false
-	}
+// Explain checks a given IDeviceEvent against each of this action's match
+// criteria, and returns the detailed results.
+func (a *Action) Explain(event deviceevent.IDeviceEvent) MatchTrace {
 
-	if !foundIn(event.Device().Path(), a.paths) {
-		return false
-	}
+	t := MatchTrace{Action: a.label}
+	d := event.Device()
 
-	if !foundIn(event.Device().Subsystem(), a.subsystems) {
-		return false
-	}
+	t.check("event", string(event.Event()), false, a.events)
+	t.check("path", d.Path(), false, a.paths)
+	t.check("subsystem", d.Subsystem(), false, a.subsystems)
+	t.check("type", d.Type(), false, a.types)
+	t.check("driver", d.Driver(), false, a.drivers)
 
-	if !foundIn(event.Device().Type(), a.types) {
-		return false
+	for _, attribute := range sortedKeys(a.attrs) {
+		value, found := d.Attrs()[attribute]
+		t.check("attr "+attribute, value, !found, a.attrs[attribute])
 	}
 
-	if !foundIn(event.Device().Driver(), a.drivers) {
-		return false
+	for _, uevent := range sortedKeys(a.uevents) {
+		value, found := d.Uevent()[uevent]
+		t.check("uevent "+uevent, value, !found, a.uevents[uevent])
 	}
 
-	for attribute, values := range a.attrs {
-		deviceAttrValue, found := event.Device().Attrs()[attribute]
-		if !found {
-			return false
+	return t
+}
+
+// Do executes the action for the given event, and returns once its commands
+// are done. Their pending retries get cancelled when the given context is
+// done, and they get terminated as well when its abort context is, see
+// WithAbort.
+// In parallel mode, the commands all run at once. In sequential mode, they
+// run one after the other. Either way, it returns an *ActionError if any of
+// them fails.
+func (a *Action) Do(
+	ctx context.Context, event deviceevent.IDeviceEvent, ex executor.IExecutor) error {
+
+	commands, err := a.commands(ctx, event)
+
+	if a.mode != modeSequential {
+		errs := make([]error, len(commands))
+		var wg sync.WaitGroup
+		for i, c := range commands {
+			wg.Add(1)
+			go func(i int, c executor.Command) {
+				defer wg.Done()
+				errs[i] = ex.RunCommand(c)
+			}(i, c)
 		}
-		if !foundIn(deviceAttrValue, values) {
-			return false
+		wg.Wait()
+
+		failed := ActionError{Action: a.label}
+		for i, e := range errs {
+			if e != nil {
+				failed.Steps = append(failed.Steps, &StepError{
+					Step:   i + 1,
+					Origin: commands[i].Origin,
+					Err:    e,
+				})
+			}
 		}
-	}
 
-	for uevent, values := range a.uevents {
-		deviceUeventValue, found := event.Device().Uevent()[uevent]
-		if !found {
-			return false
+		if len(failed.Steps) > 0 && err != nil {
+			return fmt.Errorf("%s, and %w", err, &failed)
+		} else if len(failed.Steps) > 0 {
+			return &failed
 		}
-		if !foundIn(deviceUeventValue, values) {
-			return false
+		return err
+	}
+
+	if err != nil && a.onError != onErrorContinue {
+		return err
+	}
+
+	failed := ActionError{Action: a.label}
+	for i, c := range commands {
+		if err := ex.RunCommand(c); err != nil {
+			failed.Steps = append(failed.Steps, &StepError{
+				Step:   i + 1,
+				Origin: c.Origin,
+				Err:    err,
+			})
+
+			if a.onError != onErrorContinue {
+				failed.Skipped = len(commands) - i - 1
+				break
+			}
 		}
 	}
 
-	return true
+	if len(failed.Steps) > 0 {
+		return &failed
+	}
+	return err
+}
+
+type suppressedKey struct{}
+
+// WithSuppressed returns a context for the run of an action that comes after
+// the given number of runs were suppressed by its cooldown or rate limit, which
+// its commands get as ONPLUGD_SUPPRESSED.
+func WithSuppressed(ctx context.Context, count int) context.Context {
+	return context.WithValue(ctx, suppressedKey{}, count)
+}
+
+func suppressed(ctx context.Context) int {
+	count, _ := ctx.Value(suppressedKey{}).(int)
+	return count
+}
+
+type abortKey struct{}
+
+// WithAbort returns a context for the run of an action whose commands get
+// terminated when the given abort context is done, such as when a newer run
+// of the action replaces it.
+func WithAbort(ctx context.Context, abort context.Context) context.Context {
+	return context.WithValue(ctx, abortKey{}, abort)
 }
 
-// Do executes the action for the given event.
-func (a *Action) Do(event deviceevent.IDeviceEvent, executor executor.IExecutor) error {
+// Aborted returns the abort context set on the given context with WithAbort,
+// or nil if there is none.
+func Aborted(ctx context.Context) context.Context {
+	abort, _ := ctx.Value(abortKey{}).(context.Context)
+	return abort
+}
 
-	env := os.Environ()
+// baseCommand returns what all the commands of the action run for the given
+// event have in common.
+func (a *Action) baseCommand(
+	ctx context.Context, event deviceevent.IDeviceEvent) (executor.Command, error) {
 
-	env = append(env,
-		"ONPLUGD_EVENT="+strings.ToUpper(string(event.Event())))
-	env = append(env, "ONPLUGD_PATH="+event.Device().Path())
-	env = append(env, "ONPLUGD_SUBSYSTEM="+event.Device().Subsystem())
+	env := eventEnv(event, baseEnv(a.cleanEnv))
+	for _, keyvalue := range a.env {
+		kv := strings.SplitN(keyvalue, "=", 2)
+		env = setEnv(env, kv[0], substitute(kv[1:], env)[0])
+	}
 
-	if driver := event.Device().Driver(); driver != "" {
-		env = append(env, "ONPLUGD_DRIVER="+driver)
+	if a.cooldown > 0 || a.rateLimit > 0 {
+		env = append(env, fmt.Sprintf("ONPLUGD_SUPPRESSED=%d", suppressed(ctx)))
 	}
 
-	if typ := event.Device().Type(); typ != "" {
-		env = append(env, "ONPLUGD_TYPE="+typ)
+	base := executor.Command{
+		Env:        env,
+		Dir:        a.workdir,
+		Prefix:     a.label,
+		Timeout:    a.timeout,
+		KillAfter:  a.killAfter,
+		Retry:      a.retry,
+		Credential: a.credential,
+		Context:    ctx,
+		Abort:      Aborted(ctx),
 	}
 
-	for attr, attrValue := range event.Device().Attrs() {
-		attrEnv := fmt.Sprintf("ONPLUGD_ATTR_%s", strings.ToUpper(attr))
-		env = append(env, attrEnv+"="+attrValue)
+	if a.stdin == stdinJSON {
+		payload, err := eventJSON(event, a.label)
+		if err != nil {
+			return base, err
+		}
+		base.Stdin = payload
 	}
 
-	for uevent, ueventValue := range event.Device().Uevent() {
-		ueventEnv := fmt.Sprintf("ONPLUGD_UEVENT_%s", strings.ToUpper(uevent))
-		env = append(env, ueventEnv+"="+ueventValue)
+	return base, nil
+}
+
+// RunsWhilePresent reports whether the action runs a process for as long as
+// the devices it matches are present.
+func (a *Action) RunsWhilePresent() bool {
+	return a.whilePresent != ""
+}
+
+// RunWhilePresent runs the run_while_present command of the action for the
+// device of the given event, restarting it whenever it exits, until the given
+// context is done. Its timeout doesn't apply.
+func (a *Action) RunWhilePresent(
+	ctx context.Context, event deviceevent.IDeviceEvent, ex executor.IExecutor) error {
+
+	c, err := a.baseCommand(ctx, event)
+	if err != nil {
+		return err
 	}
 
-	for _, cmdline := range a.execs {
-		executor.Exec(cmdline, env, a.name)
+	cmdline := a.whilePresent
+	if t := a.templates[cmdline]; t != nil {
+		if cmdline, err = renderCommand(t, event); err != nil {
+			return fmt.Errorf("Can't render the command line of %s: %s: %s",
+				a.label, a.origins[a.whilePresent], err)
+		}
 	}
 
+	c.Args = append(a.interpreterArgs(), "-c", utils.Expand(cmdline))
+	c.Origin = a.origins[a.whilePresent]
+	c.Timeout = 0
+	ex.KeepRunning(c)
 	return nil
 }
 
-// NewActionFromFile creates a new action from the given file path.
-func NewActionFromFile(fullpath string) (*Action, error) {
+// StepError is the failure of one of the commands of an action.
+type StepError struct {
+	// Step is the position of the command in the action, starting at 1.
+	Step int
+	// Origin is where the command is defined.
+	Origin string
+	Err    error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %d (%s): %s", e.Step, e.Origin, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// ActionError is the error for an action whose commands failed.
+type ActionError struct {
+	Action string
+	Steps  []*StepError
+	// Skipped is how many commands were not run because of the failures.
+	Skipped int
+}
+
+func (e *ActionError) Error() string {
+	var steps []string
+	for _, step := range e.Steps {
+		steps = append(steps, step.Error())
+	}
+
+	msg := fmt.Sprintf("Action %s failed at %s", e.Action, strings.Join(steps, "; "))
+	if e.Skipped > 0 {
+		msg += fmt.Sprintf(", %d remaining step(s) skipped", e.Skipped)
+	}
+	return msg
+}
+
+// step is one of the commands of an action: an exec line, an argv value or a
+// script, by index.
+type step struct {
+	key   string
+	index int
+}
 
-	a := Action{name: path.Base(fullpath)}
+// commands returns the commands to run for the given event, in the order of
+// the config. The commands that can't be rendered are left out, and reported
+// in the error.
+func (a *Action) commands(
+	ctx context.Context, event deviceevent.IDeviceEvent) ([]executor.Command, error) {
 
-	// ShadowLoad (instead of Load) lets us list keys multiple times.
-	conf, err := ini.ShadowLoad(fullpath)
+	base, err := a.baseCommand(ctx, event)
 	if err != nil {
 		return nil, err
 	}
 
-	a.events = loadSliceFromShadow(
-		conf.Section("match").Key("event").ValueWithShadows())
+	var commands []executor.Command
+	var errs []string
+	for _, step := range a.steps {
+		c := base
+		switch step.key {
+		case "exec":
+			// Exec lines are passed to the interpreter with -c, the way shells
+			// and most scripting languages take them.
+			cmdline := a.execs[step.index]
+			c.Origin = a.origins[cmdline]
+			if t := a.templates[cmdline]; t != nil {
+				rendered, err := renderCommand(t, event)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s", c.Origin, err))
+					continue
+				}
+				cmdline = rendered
+			}
+			c.Args = append(a.interpreterArgs(), "-c", utils.Expand(cmdline))
+
+		case "argv":
+			argv := a.argvs[step.index]
+			c.Args = substitute(argv.args, base.Env)
+			c.Args[0] = utils.Expand(c.Args[0])
+			c.Origin = argv.origin
+
+		case "script":
+			c.Args = a.interpreterArgs()
+			c.Script = a.scripts[step.index]
+			c.Origin = a.origins[c.Script]
+		}
+		commands = append(commands, c)
+	}
+
+	if len(errs) > 0 {
+		return commands, fmt.Errorf("Can't render the command lines of %s: %s",
+			a.label, strings.Join(errs, "; "))
+	}
+	return commands, nil
+}
+
+// NewActionsFromFile creates the actions described in the given file path,
+// one for each of its [action] sections, expanding the given variables in its
+// values. Issues that make the config unusable are returned as a
+// *ConfigError; lesser ones can be retrieved with Warnings().
+func NewActionsFromFile(fullpath string, vars Vars) ([]*Action, error) {
+
+	actions, diagnostics := load(fullpath, vars)
+	if actions == nil {
+		return nil, &ConfigError{Diagnostics: diagnostics}
+	}
+
+	for _, a := range actions {
+		a.warnings = diagnostics
+	}
+	return actions, nil
+}
+
+// How the commands of an action run.
+const (
+	// All at once.
+	modeParallel = "parallel"
+	// One after the other, each waiting for the previous one to complete.
+	modeSequential = "sequential"
+)
+
+// What happens when a command fails in sequential mode.
+const (
+	onErrorStop     = "stop"
+	onErrorContinue = "continue"
+)
+
+// What commands get on their standard input.
+const (
+	stdinNone = "none"
+	// The event as JSON, see eventJSON.
+	stdinJSON = "json"
+)
+
+// How the runs of an action relate to each other, such as when a device gets
+// plugged while the action still runs for the previous one.
+const (
+	// Runs happen at the same time.
+	ConcurrencyParallel = "parallel"
+	// Runs wait for the previous ones to complete.
+	ConcurrencyQueue = "queue"
+	// Runs terminate the previous ones.
+	ConcurrencyReplace = "replace"
+	// Runs don't happen while a previous one is still going.
+	ConcurrencySkip = "skip"
+	// Runs for the same device wait for the previous ones to complete, in the
+	// order of the events.
+	ConcurrencyDevice = "device"
+)
+
+// DefaultInterpreter runs the exec lines and scripts of the actions that don't
+// set an interpreter.
+const DefaultInterpreter = "/bin/sh"
+
+// The delays between retries of failed commands, unless retry_backoff says
+// otherwise.
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// interpreterArgs returns a copy of the interpreter command of the action.
+func (a *Action) interpreterArgs() []string {
+	if len(a.interpreter) == 0 {
+		return []string{DefaultInterpreter}
+	}
+	return append([]string(nil), a.interpreter...)
+}
+
+// DefaultPriority is the priority of the actions that don't set one, and
+// whose config file name has no numeric prefix.
+const DefaultPriority = 50
+
+// Priority returns the priority of the action: actions with lower values
+// handle events first.
+func (a *Action) Priority() int {
+	return a.priority
+}
+
+// Final reports whether the action stops the actions with a lower priority
+// from handling the events it matches.
+func (a *Action) Final() bool {
+	return a.final
+}
+
+// Concurrency returns the concurrency policy of the action, one of the
+// Concurrency* values.
+func (a *Action) Concurrency() string {
+	if a.concurrency == "" {
+		return ConcurrencyParallel
+	}
+	return a.concurrency
+}
+
+// Lock returns the name of the lock the action holds while it runs, so that it
+// never overlaps with the other actions holding it, or an empty string.
+func (a *Action) Lock() string {
+	return a.lock
+}
+
+// Delay returns how long after an event the action runs, or zero to run right
+// away.
+func (a *Action) Delay() time.Duration {
+	return a.delay
+}
+
+// Cooldown returns how long the action doesn't run again for a device it just
+// ran for, or zero.
+func (a *Action) Cooldown() time.Duration {
+	return a.cooldown
+}
+
+// RateLimit returns how many times the action runs at most per period of the
+// returned duration, or zero if it has no limit.
+func (a *Action) RateLimit() (int, time.Duration) {
+	return a.rateLimit, a.ratePeriod
+}
+
+// Name returns the name of the action within its config file, i.e. "foo" for
+// an [action "foo"] section, or an empty string for a plain [action] section.
+func (a *Action) Name() string {
+	return a.name
+}
+
+// Warnings returns the issues found in the config that this action was loaded
+// from, which did not prevent it from loading.
+func (a *Action) Warnings() []Diagnostic {
+	return a.warnings
+}
+
+// load creates the actions described in the given file path, and returns them
+// along with all the issues found in the file. The actions are nil if any of
+// those issues is an error.
+func load(fullpath string, vars Vars) ([]*Action, []Diagnostic) {
+
+	l := newLinter(fullpath)
+
+	doc, err := loadDocument(fullpath)
+	if err != nil {
+		l.report(Error, 0, "%s", err)
+		return nil, l.diagnostics
+	}
+	l.lines = doc.lines
+
+	l.checkSchema(doc)
+
+	templates := make(map[string]*template)
+	loadTemplates(l, doc, fullpath, nil, templates, map[string]bool{fullpath: true})
+
+	matches := make(map[string]*docSection)
+	var sections []*docSection
+	for _, section := range doc.sections {
+		kind, name := parseSectionName(section.name)
+		switch kind {
+		case "match":
+			matches[name] = section
+		case "action":
+			sections = append(sections, section)
+		}
+	}
+
+	var actions []*Action
+	names := make(map[string]bool)
+	for _, section := range sections {
+		_, name := parseSectionName(section.name)
+		names[name] = true
+
+		label := path.Base(fullpath)
+		if name != "" {
+			label += ":" + name
+		}
+
+		matchSettings := sectionSettings(matches[name])
+		actionSettings := sectionSettings(section)
+		files := []string{fullpath}
+		positions := section.positions
+
+		// Settings given explicitly override the template's.
+		if uses := actionSettings["use"]; len(uses) > 0 {
+			line := l.keyLine(section.name, "use", uses[0])
+			if len(uses) > 1 {
+				l.report(Error, line, "only one template may be used per action")
+			}
+			if instance := instantiate(l, line, templates, uses[0]); instance != nil {
+				positions = instance.mergePositions(actionSettings, positions)
+				matchSettings = instance.merge(matchSettings, schema["match"])
+				actionSettings = instance.merge(actionSettings, schema["action"])
+				files = append(files, instance.files...)
+			}
+		}
+
+		matchName := sectionName("match", name)
+		l.expandSettings(matchName, matchSettings, vars)
+		l.expandSettings(section.name, actionSettings, vars)
+
+		a := Action{label: label, name: name, priority: filePriority(fullpath)}
+		loadMatch(l, &a, matchName, matchSettings)
+		loadAction(l, &a, section.name, actionSettings, files, positions)
+		actions = append(actions, &a)
+	}
+
+	if len(actions) == 0 {
+		l.report(Error, 0, "no [action] section, this config does nothing")
+	}
+
+	for name, section := range matches {
+		if len(actions) > 0 && !names[name] {
+			l.report(Error, l.sectionLine(section.name),
+				"no [%s] section for [%s]",
+				sectionName("action", name), section.name)
+		}
+	}
+
+	if l.failed() {
+		return nil, l.diagnostics
+	}
+
+	return actions, l.diagnostics
+}
+
+// settings are the values of the keys of a section.
+type settings map[string][]string
+
+// loadMatch loads the given criteria of the given [match] section into the
+// given action. Without criteria, the action matches all devices.
+func loadMatch(l *linter, a *Action, section string, s settings) {
+
+	a.events = s["event"]
 	if len(a.events) == 0 {
 		a.events = []string{"COLDPLUG", "ADD"}
 	}
 
-	a.paths = loadSliceFromShadow(
-		conf.Section("match").Key("path").ValueWithShadows())
-	a.subsystems = loadSliceFromShadow(
-		conf.Section("match").Key("subsystem").ValueWithShadows())
-	a.types = loadSliceFromShadow(
-		conf.Section("match").Key("type").ValueWithShadows())
-	a.drivers = loadSliceFromShadow(
-		conf.Section("match").Key("driver").ValueWithShadows())
+	a.paths = s["path"]
+	a.subsystems = s["subsystem"]
+	a.types = s["type"]
+	a.drivers = s["driver"]
 
 	a.attrs = make(map[string][]string)
-	err = loadMapFromShadow(
-		a.attrs, conf.Section("match").Key("attr").ValueWithShadows())
+	loadMapFromShadow(l, section, "attr", a.attrs, s["attr"])
+
+	a.uevents = make(map[string][]string)
+	loadMapFromShadow(l, section, "uevent", a.uevents, s["uevent"])
+
+	l.checkMatch(a, section)
+}
+
+// loadAction loads the given settings of the given [action] section, which
+// come from the given files with their commands at the given positions, into
+// the given action.
+func loadAction(
+	l *linter, a *Action, section string, s settings, files []string, positions []position) {
+
+	a.execs = s["exec"]
+	a.scripts = s["script"]
+	if values := s["run_while_present"]; len(values) > 0 {
+		a.whilePresent = values[len(values)-1]
+	}
+
+	if values := s["interpreter"]; len(values) > 0 {
+		value := values[len(values)-1]
+		a.interpreter = strings.Fields(utils.Expand(value))
+		l.checkInterpreter(section, value, a.interpreter)
+	}
+
+	// The index in argvs of each valid argv value.
+	argvIndexes := make(map[int]int)
+
+	for i, value := range s["argv"] {
+		args, err := parseArgv(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "argv", value), "%s", err)
+			continue
+		}
+
+		// The value got reformatted, but the command is likely as written.
+		command := encodeArgv(args[:1])
+		l.checkArgv(l.keyLine(section, "argv", command[1:len(command)-1]), args)
+		argvIndexes[i] = len(a.argvs)
+		a.argvs = append(a.argvs, argv{args: args})
+	}
+
+	l.checkExecs(section, a.execs, len(a.argvs)+len(a.scripts) > 0 || a.whilePresent != "")
+
+	a.origins = make(map[string]string)
+	for _, p := range positions {
+		values := s[p.key]
+		if p.index >= len(values) {
+			continue
+		}
+		value := values[p.index]
+
+		switch p.key {
+		case "exec", "script":
+			a.origins[value] = p.origin()
+			a.steps = append(a.steps, step{key: p.key, index: p.index})
+		case "argv":
+			if index, valid := argvIndexes[p.index]; valid {
+				a.argvs[index].origin = p.origin()
+				a.steps = append(a.steps, step{key: p.key, index: index})
+			}
+		case "run_while_present":
+			a.origins[value] = p.origin()
+		}
+	}
+
+	whilePresent := []string{a.whilePresent}
+	if a.whilePresent == "" {
+		whilePresent = nil
+	}
+
+	a.templates = make(map[string]*texttemplate.Template)
+	for _, cmdline := range append(whilePresent, a.execs...) {
+		key := "exec"
+		if cmdline == a.whilePresent {
+			key = "run_while_present"
+		}
+		line := l.keyLine(section, key, strings.SplitN(cmdline, "\n", 2)[0])
+
+		t, err := parseCommand(cmdline)
+		if err != nil {
+			l.report(Error, line, "invalid command line template: %s", err)
+			continue
+		}
+		if t == nil {
+			continue
+		}
+		if !meantAsTemplate(t.Tree.Root) {
+			l.report(Warning, line,
+				`command line template doesn't use the event, write {{"{{"}} for literal braces`)
+		}
+		a.templates[cmdline] = t
+	}
+	if len(a.templates) > 0 && !isPosixShell(a.interpreterArgs()) {
+		l.report(Error, l.keyLine(section, "interpreter", ""),
+			"command line templates quote values for a POSIX shell, not for '%s'",
+			a.interpreterArgs()[0])
+	}
+
+	if values := s["priority"]; len(values) > 0 {
+		value := values[len(values)-1]
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "priority", value),
+				"invalid priority: expected an integer, got '%s'", value)
+		}
+		a.priority = priority
+	}
+
+	a.mode = l.choice(section, "mode", s, modeParallel, modeSequential)
+	a.onError = l.choice(section, "on_error", s, onErrorStop, onErrorContinue)
+	if a.onError != "" && a.mode != modeSequential {
+		l.report(Warning, l.keyLine(section, "on_error", ""),
+			"on_error has no effect without mode = %s", modeSequential)
+	}
+
+	a.timeout = l.duration(section, "timeout", s)
+	a.killAfter = l.duration(section, "kill_after", s)
+	if a.killAfter > 0 && a.timeout == 0 {
+		l.report(Warning, l.keyLine(section, "kill_after", ""),
+			"kill_after has no effect without a timeout")
+	}
+
+	a.stdin = l.choice(section, "stdin", s, stdinNone, stdinJSON)
+	a.credential = l.credential(section, s, files)
+
+	if values := s["workdir"]; len(values) > 0 {
+		value := values[len(values)-1]
+		a.workdir = utils.Expand(value)
+		if !path.IsAbs(a.workdir) {
+			l.report(Error, l.keyLine(section, "workdir", value),
+				"invalid workdir: expected an absolute path, got '%s'", value)
+		} else if info, err := os.Stat(a.workdir); err != nil || !info.IsDir() {
+			l.report(Warning, l.keyLine(section, "workdir", value),
+				"workdir %s is not a directory, at least for now", a.workdir)
+		}
+	}
+
+	for _, value := range s["env"] {
+		if _, _, err := parseEnv(value); err != nil {
+			l.report(Error, l.keyLine(section, "env", value), "%s", err)
+			continue
+		}
+		a.env = append(a.env, value)
+	}
+
+	if values := s["clean_env"]; len(values) > 0 {
+		value := values[len(values)-1]
+		cleanEnv, err := strconv.ParseBool(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "clean_env", value),
+				"invalid clean_env: expected true or false, got '%s'", value)
+		}
+		a.cleanEnv = cleanEnv
+	}
+
+	if values := s["retries"]; len(values) > 0 {
+		value := values[len(values)-1]
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			l.report(Error, l.keyLine(section, "retries", value),
+				"invalid retries: expected a non-negative integer, got '%s'", value)
+		} else {
+			a.retry.Retries = retries
+		}
+	}
+
+	a.retry.MinBackoff, a.retry.MaxBackoff = defaultMinBackoff, defaultMaxBackoff
+	if values := s["retry_backoff"]; len(values) > 0 {
+		value := values[len(values)-1]
+		min, max, err := parseBackoff(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "retry_backoff", value),
+				"invalid retry_backoff: expected a duration such as 1s or a range such as 500ms..10s, got '%s'",
+				value)
+		} else {
+			a.retry.MinBackoff, a.retry.MaxBackoff = min, max
+		}
+	}
+
+	for _, value := range s["retry_on"] {
+		for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			status, err := strconv.Atoi(field)
+			if err != nil || status < 1 || status > 255 {
+				l.report(Error, l.keyLine(section, "retry_on", value),
+					"invalid retry_on: expected exit statuses such as 1, 75, got '%s'", field)
+				continue
+			}
+			a.retry.On = append(a.retry.On, status)
+		}
+	}
+
+	if a.retry.Retries == 0 && (len(s["retry_backoff"]) > 0 || len(s["retry_on"]) > 0) {
+		l.report(Warning, l.keyLine(section, "retries", ""),
+			"retry_backoff and retry_on have no effect without retries")
+	}
+
+	a.concurrency = l.choice(section, "concurrency", s, ConcurrencyParallel,
+		ConcurrencyQueue, ConcurrencyReplace, ConcurrencySkip, ConcurrencyDevice)
+
+	if values := s["lock"]; len(values) > 0 {
+		value := values[len(values)-1]
+		if !lockRegexp.MatchString(value) {
+			l.report(Error, l.keyLine(section, "lock", value),
+				"invalid lock: expected a name such as display, got '%s'", value)
+		}
+		a.lock = value
+	}
+
+	a.delay = l.duration(section, "delay", s)
+	a.cooldown = l.duration(section, "cooldown", s)
+
+	if values := s["rate_limit"]; len(values) > 0 {
+		value := values[len(values)-1]
+		limit, period, err := parseRate(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "rate_limit", value),
+				"invalid rate_limit: expected a rate such as 5/min, got '%s'", value)
+		}
+		a.rateLimit, a.ratePeriod = limit, period
+	}
+
+	if values := s["final"]; len(values) > 0 {
+		value := values[len(values)-1]
+		final, err := strconv.ParseBool(value)
+		if err != nil {
+			l.report(Error, l.keyLine(section, "final", value),
+				"invalid final: expected true or false, got '%s'", value)
+		}
+		a.final = final
+	}
+}
+
+// parseBackoff parses a retry_backoff value, which is either a range such as
+// 500ms..10s or a single duration for a constant delay.
+func parseBackoff(value string) (time.Duration, time.Duration, error) {
+	parts := strings.SplitN(value, "..", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	min, err := time.ParseDuration(strings.TrimSpace(parts[0]))
 	if err != nil {
-		return nil, err
+		return 0, 0, err
+	}
+	max, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if min <= 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid range %s..%s", min, max)
 	}
 
-	a.uevents = make(map[string][]string)
-	err = loadMapFromShadow(
-		a.uevents, conf.Section("match").Key("uevent").ValueWithShadows())
+	return min, max, nil
+}
+
+// parseRate parses a rate_limit value such as 5/min, where the period is a
+// unit (s, min, h) or a duration (30s).
+func parseRate(value string) (int, time.Duration, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("missing period")
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || limit < 1 {
+		return 0, 0, fmt.Errorf("invalid limit")
+	}
+
+	units := map[string]time.Duration{
+		"s": time.Second, "sec": time.Second, "second": time.Second,
+		"min": time.Minute, "minute": time.Minute,
+		"h": time.Hour, "hour": time.Hour,
+	}
+	unit := strings.TrimSpace(parts[1])
+	period, found := units[unit]
+	if !found {
+		if period, err = time.ParseDuration(unit); err != nil || period <= 0 {
+			return 0, 0, fmt.Errorf("invalid period")
+		}
+	}
+
+	return limit, period, nil
+}
+
+var lockRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var priorityRegexp = regexp.MustCompile(`^(\d+)-`)
+
+// filePriority returns the priority given by the numeric prefix of a config
+// file name, like 10 for 10-foo.conf, or DefaultPriority if there is none.
+func filePriority(fullpath string) int {
+	parts := priorityRegexp.FindStringSubmatch(path.Base(fullpath))
+	if parts == nil {
+		return DefaultPriority
+	}
+
+	priority, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return nil, err
+		return DefaultPriority
 	}
+	return priority
+}
 
-	a.execs = conf.Section("action").Key("exec").ValueWithShadows()
+// parseSectionName splits a section name such as `action "foo"` into its kind
+// and name, i.e. "action" and "foo".
+func parseSectionName(section string) (string, string) {
+	parts := sectionRegexp.FindStringSubmatch(section)
+	if parts == nil {
+		return section, ""
+	}
+	return parts[1], parts[2]
+}
 
-	return &a, nil
+// sectionName is the reverse of parseSectionName.
+func sectionName(kind string, name string) string {
+	if name == "" {
+		return kind
+	}
+	return fmt.Sprintf("%s \"%s\"", kind, name)
 }
 
+var sectionRegexp = regexp.MustCompile(`^(\w+)(?:\s+"([^"]*)")?$`)
+
 func match(s1, s2 string) bool {
 	return len(s1) > 0 && strings.ToLower(s1) == strings.ToLower(s2)
 }
@@ -172,8 +959,10 @@ func foundIn(needle string, haystack []string) bool {
 	return false
 }
 
-// Populate a map from a slice of entries that look like "k=v"
-func loadMapFromShadow(m map[string][]string, shadow []string) error {
+// Populate a map from a slice of entries that look like "k=v", reporting the
+// malformed entries of the given key to the linter.
+func loadMapFromShadow(
+	l *linter, section string, key string, m map[string][]string, shadow []string) {
 	for _, entry := range shadow {
 
 		// Shadowloading adds at least one empty value to the shadow variable, let's
@@ -184,15 +973,15 @@ func loadMapFromShadow(m map[string][]string, shadow []string) error {
 
 		keyvalue := strings.SplitN(entry, "=", 2)
 		if len(keyvalue) != 2 {
-			return fmt.Errorf(
-				"Invalid attribute: expected something formatted as KEY=VALUE, got '%s'", entry)
+			l.report(Error, l.keyLine(section, key, entry),
+				"invalid %s: expected something formatted as KEY=VALUE, got '%s'",
+				key, entry)
+			continue
 		}
 		k := strings.TrimSpace(keyvalue[0])
 		v := strings.TrimSpace(keyvalue[1])
 		m[k] = append(m[k], v)
 	}
-
-	return nil
 }
 
 func loadSliceFromShadow(shadow []string) []string {
@@ -0,0 +1,650 @@
+package action
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/executor"
+)
+
+func writeConf(t *testing.T, content string) string {
+	t.Helper()
+	fullpath := path.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(fullpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fullpath
+}
+
+func Test_NewActionsFromFileNamed(t *testing.T) {
+	fullpath := writeConf(t, `
+[match "dock-in"]
+event = ADD
+attr = idProduct=1234
+
+[action "dock-in"]
+exec = true
+
+[match "dock-out"]
+event = REMOVE
+attr = idProduct=1234
+
+[action "dock-out"]
+exec = false
+`)
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	if len(actions) != 2 {
+		t.Fatalf("NewActionsFromFile() returned %d actions, want 2", len(actions))
+	}
+
+	d := device.New("/devices/dock")
+	d.Attrs()["idProduct"] = "1234"
+
+	for i, tt := range []struct {
+		name  string
+		event deviceevent.Event
+	}{
+		{name: "dock-in", event: deviceevent.Add},
+		{name: "dock-out", event: deviceevent.Remove},
+	} {
+		if actions[i].Name() != tt.name {
+			t.Errorf("action %d is named %v, want %v", i, actions[i].Name(), tt.name)
+		}
+		if !actions[i].Match(deviceevent.New(tt.event, d)) {
+			t.Errorf("action %v does not match %v", tt.name, tt.event)
+		}
+	}
+}
+
+func Test_NewActionsFromFileOrphanMatch(t *testing.T) {
+	fullpath := writeConf(t, `
+[match "dock-in"]
+event = ADD
+
+[action "dock-out"]
+exec = true
+`)
+
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() accepted a [match] section without its [action]")
+	}
+}
+
+func Test_NewActionsFromFileTemplate(t *testing.T) {
+	fullpath := writeConf(t, `
+include = common.inc
+
+[action "de"]
+use = keyboard-layout(serial=ABC, layout=de)
+
+[match "fr"]
+event = CHANGE
+
+[action "fr"]
+use = keyboard-layout(serial="X,Y", layout=fr)
+`)
+	err := os.WriteFile(path.Join(path.Dir(fullpath), "common.inc"), []byte(`
+[template "keyboard-layout"]
+params = serial, layout
+subsystem = usb
+attr = serial=${serial}
+exec = setxkbmap ${layout} ${HOME}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	if got := actions[0].attrs["serial"]; len(got) != 1 || got[0] != "ABC" {
+		t.Errorf("de: attr serial = %v, want [ABC]", got)
+	}
+	// Placeholders that are not parameters are left alone.
+	if got := actions[0].execs; len(got) != 1 || got[0] != "setxkbmap 'de' ${HOME}" {
+		t.Errorf("de: execs = %v, want [setxkbmap 'de' ${HOME}]", got)
+	}
+
+	// Explicit settings override the template's.
+	if got := actions[1].events; len(got) != 1 || got[0] != "CHANGE" {
+		t.Errorf("fr: events = %v, want [CHANGE]", got)
+	}
+	if got := actions[1].attrs["serial"]; len(got) != 1 || got[0] != "X,Y" {
+		t.Errorf("fr: attr serial = %v, want [X,Y]", got)
+	}
+
+	if got := Dependencies(fullpath); len(got) != 1 ||
+		got[0] != path.Join(path.Dir(fullpath), "common.inc") {
+		t.Errorf("Dependencies() = %v", got)
+	}
+}
+
+func Test_NewActionsFromFileTemplateErrors(t *testing.T) {
+	for _, use := range []string{
+		"nope",
+		"layout",
+		"layout(layout=de, extra=1)",
+		"layout(layout)",
+	} {
+		fullpath := writeConf(t, `
+[template "layout"]
+params = layout
+exec = setxkbmap ${layout}
+
+[action]
+use = `+use+`
+`)
+		if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+			t.Errorf("NewActionsFromFile() accepted 'use = %s'", use)
+		}
+	}
+}
+
+func Test_NewActionsFromFileVars(t *testing.T) {
+	t.Setenv("TEST_DIR", "/srv")
+
+	varsPath := path.Join(t.TempDir(), VarsFile)
+	err := os.WriteFile(varsPath, []byte("DOCK_SERIAL = 1234\nDOCK_LOG = ${TEST_DIR}/${DOCK_SERIAL}.log\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := LoadVars(varsPath)
+	if err != nil {
+		t.Fatalf("LoadVars() error = %v", err)
+	}
+
+	fullpath := writeConf(t, `
+[match]
+attr = serial=${DOCK_SERIAL}
+
+[action]
+workdir = ~root
+exec = f=$(date) && echo ${f} $${DOCK_SERIAL} ${ONPLUGD_PATH} >> ${DOCK_LOG}
+`)
+
+	actions, err := NewActionsFromFile(fullpath, vars)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	if got := actions[0].attrs["serial"]; len(got) != 1 || got[0] != "1234" {
+		t.Errorf("attrs[serial] = %v, want 1234", got)
+	}
+	// Commands only get the variables of vars.conf, the rest is the shell's.
+	want := "f=$(date) && echo ${f} ${DOCK_SERIAL} ${ONPLUGD_PATH} >> /srv/1234.log"
+	if got := actions[0].execs; len(got) != 1 || got[0] != want {
+		t.Errorf("execs = %v, want [%s]", got, want)
+	}
+	if root, err := user.Lookup("root"); err == nil && actions[0].workdir != root.HomeDir {
+		t.Errorf("workdir = %v, want %v", actions[0].workdir, root.HomeDir)
+	}
+
+	fullpath = writeConf(t, "[match]\nattr = serial=${NOT_DEFINED_ANYWHERE}\n[action]\nexec = true\n")
+	if _, err := NewActionsFromFile(fullpath, vars); err == nil {
+		t.Errorf("NewActionsFromFile() accepted an unknown variable")
+	}
+}
+
+func Test_NewActionsFromFilePriority(t *testing.T) {
+	dir := t.TempDir()
+	fullpath := path.Join(dir, "10-dock.conf")
+	err := os.WriteFile(fullpath, []byte(`
+[action "plain"]
+exec = true
+
+[action "explicit"]
+exec = true
+priority = 5
+final = true
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	if got := actions[0]; got.Priority() != 10 || got.Final() {
+		t.Errorf("plain: priority = %d, final = %v, want 10, false",
+			got.Priority(), got.Final())
+	}
+	if got := actions[1]; got.Priority() != 5 || !got.Final() {
+		t.Errorf("explicit: priority = %d, final = %v, want 5, true",
+			got.Priority(), got.Final())
+	}
+
+	if got := filePriority(path.Join(dir, "dock.conf")); got != DefaultPriority {
+		t.Errorf("filePriority() = %d, want %d", got, DefaultPriority)
+	}
+
+	fullpath = writeConf(t, "[action]\nexec = true\npriority = high\n")
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() accepted a non-numeric priority")
+	}
+}
+
+func Test_NewActionsFromFileScript(t *testing.T) {
+	fullpath := writeConf(t, `[action]
+interpreter = /bin/bash -e
+script = """
+cd /tmp
+echo "$ONPLUGD_PATH"
+"""
+exec = true
+`)
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	a := actions[0]
+
+	want := "\ncd /tmp\necho \"$ONPLUGD_PATH\"\n"
+	if len(a.scripts) != 1 || a.scripts[0] != want {
+		t.Errorf("scripts = %q, want [%q]", a.scripts, want)
+	}
+	if got := a.interpreterArgs(); len(got) != 2 || got[0] != "/bin/bash" || got[1] != "-e" {
+		t.Errorf("interpreterArgs() = %v, want [/bin/bash -e]", got)
+	}
+	if got := a.origins[a.scripts[0]]; got != fullpath+":3" {
+		t.Errorf("script origin = %v, want %v:3", got, fullpath)
+	}
+	if got := a.origins["true"]; got != fullpath+":7" {
+		t.Errorf("exec origin = %v, want %v:7", got, fullpath)
+	}
+
+	fullpath = writeConf(t, "[action]\nscript = true\n")
+	if _, err := NewActionsFromFile(fullpath, nil); err != nil {
+		t.Errorf("NewActionsFromFile() rejected an action with only a script: %v", err)
+	}
+}
+
+func Test_NewActionsFromFileRetry(t *testing.T) {
+	fullpath := writeConf(t, `[action]
+exec = true
+retries = 3
+retry_backoff = 1s..4s
+retry_on = 1, 75
+`)
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	want := executor.RetryPolicy{
+		Retries: 3, MinBackoff: time.Second, MaxBackoff: 4 * time.Second, On: []int{1, 75}}
+	if got := actions[0].retry; !reflect.DeepEqual(got, want) {
+		t.Errorf("retry = %+v, want %+v", got, want)
+	}
+}
+
+func Test_NewActionsFromFileCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullpath := writeConf(t, "[action]\nexec = true\nuser = "+current.Username+"\n")
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	want := &executor.Credential{User: current.Username, Home: current.HomeDir}
+	want.Uid, _ = parseID(current.Uid)
+	want.Gid, _ = parseID(current.Gid)
+	if want.Groups, err = userGroups(current); err != nil {
+		t.Fatal(err)
+	}
+	if got := actions[0].credential; !reflect.DeepEqual(got, want) {
+		t.Errorf("credential = %+v, want %+v", got, want)
+	}
+
+	fullpath = writeConf(t, "[action]\nexec = true\nuser = no-such-user\n")
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() accepted an unknown user")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a config file requires root")
+	}
+	nobody, err := user.LookupId("65534")
+	if err != nil {
+		t.Skip("no user 65534 to own config files")
+	}
+
+	fullpath = writeConf(t, "[action]\nexec = true\nuser = root\n")
+	if err := os.Chown(fullpath, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() let a config not owned by root run commands as root")
+	}
+
+	fullpath = writeConf(t, "[action]\nexec = true\n")
+	if err := os.Chown(fullpath, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	actions, err = NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	if got := actions[0].credential; got == nil || got.User != nobody.Username {
+		t.Errorf("credential = %+v, want the owner %s", got, nobody.Username)
+	}
+
+	// A template from a file root doesn't own is no way around it.
+	fullpath = writeConf(t, "include = common.inc\n[action]\nuse = as-root\n")
+	include := path.Join(path.Dir(fullpath), "common.inc")
+	err = os.WriteFile(include, []byte("[template \"as-root\"]\nexec = true\nuser = root\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(include, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() let a template not owned by root run commands as root")
+	}
+
+	// Nor is a file root doesn't own that includes the template's.
+	fullpath = writeConf(t, "include = outer.inc\n[action]\nuse = as-root\n")
+	outer := path.Join(path.Dir(fullpath), "outer.inc")
+	if err := os.WriteFile(outer, []byte("include = common.inc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(outer, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	include = path.Join(path.Dir(fullpath), "common.inc")
+	err = os.WriteFile(include, []byte("[template \"as-root\"]\nexec = true\nuser = root\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() let an include not owned by root run commands as root")
+	}
+
+	// Nor are variables from a file root doesn't own.
+	varsPath := path.Join(t.TempDir(), VarsFile)
+	if err := os.WriteFile(varsPath, []byte("CMD = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(varsPath, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadVars(varsPath); err == nil {
+		t.Errorf("LoadVars() accepted variables not owned by root")
+	}
+}
+
+func Test_NewActionsFromFileEnv(t *testing.T) {
+	t.Setenv("SECRET", "hunter2")
+	fullpath := writeConf(t, `[action]
+exec = true
+workdir = /tmp
+env = LANG=C
+env = DEVICE=${ONPLUGD_PATH}
+clean_env = true
+`)
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	event := deviceevent.New(deviceevent.Add, device.New("/devices/usb1"))
+	commands, err := actions[0].commands(context.Background(), event)
+	if err != nil {
+		t.Fatalf("commands() error = %v", err)
+	}
+
+	env := strings.Join(commands[0].Env, "\n")
+	for _, want := range []string{"LANG=C", "DEVICE=/devices/usb1", "ONPLUGD_PATH=/devices/usb1", "PATH="} {
+		if !strings.Contains(env, want) {
+			t.Errorf("commands() env = %v, want %v in it", commands[0].Env, want)
+		}
+	}
+	if strings.Contains(env, "SECRET") {
+		t.Errorf("commands() env = %v, want a clean environment", commands[0].Env)
+	}
+	if commands[0].Dir != "/tmp" {
+		t.Errorf("commands() dir = %v, want /tmp", commands[0].Dir)
+	}
+}
+
+func Test_NewActionsFromFileThrottle(t *testing.T) {
+	fullpath := writeConf(t, "[action]\nexec = true\ndelay = 3s\ncooldown = 10s\nrate_limit = 5/min\n")
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	a := actions[0]
+
+	if limit, period := a.RateLimit(); a.Cooldown() != 10*time.Second || limit != 5 || period != time.Minute {
+		t.Errorf("cooldown = %s, rate limit = %d/%s, want 10s, 5/1m0s", a.Cooldown(), limit, period)
+	}
+	if a.Delay() != 3*time.Second {
+		t.Errorf("delay = %s, want 3s", a.Delay())
+	}
+
+	event := deviceevent.New(deviceevent.Add, device.New("/devices/usb1"))
+	commands, err := a.commands(WithSuppressed(context.Background(), 3), event)
+	if err != nil {
+		t.Fatalf("commands() error = %v", err)
+	}
+	if env := strings.Join(commands[0].Env, "\n"); !strings.Contains(env, "ONPLUGD_SUPPRESSED=3") {
+		t.Errorf("commands() env = %v, want ONPLUGD_SUPPRESSED=3 in it", commands[0].Env)
+	}
+}
+
+func Test_NewActionsFromFileWhilePresent(t *testing.T) {
+	fullpath := writeConf(t, "[action]\nrun_while_present = logger -f {{.Device.Uevent.DEVNAME}}\ntimeout = 5s\n")
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	a := actions[0]
+	if !a.RunsWhilePresent() {
+		t.Fatalf("RunsWhilePresent() = false, want true")
+	}
+
+	d := device.New("/devices/usb1/tty/ttyUSB0")
+	d.Uevent()["DEVNAME"] = "/dev/ttyUSB0"
+	ex := &fakeExecutor{}
+	if err := a.RunWhilePresent(context.Background(), deviceevent.New(deviceevent.Add, d), ex); err != nil {
+		t.Fatalf("RunWhilePresent() error = %v", err)
+	}
+	if want := []string{"logger -f '/dev/ttyUSB0'"}; !reflect.DeepEqual(ex.ran, want) {
+		t.Errorf("RunWhilePresent() ran %v, want %v", ex.ran, want)
+	}
+}
+
+// fakeExecutor records the commands it gets, and fails the ones whose last
+// argument is "false".
+type fakeExecutor struct {
+	ran  []string
+	lock sync.Mutex
+}
+
+func (e *fakeExecutor) RunCommand(c executor.Command) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	last := c.Args[len(c.Args)-1]
+	e.ran = append(e.ran, last)
+	if last == "false" {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func (e *fakeExecutor) KeepRunning(c executor.Command) {
+	e.RunCommand(c)
+}
+
+func Test_DoSequential(t *testing.T) {
+	d := device.New("/devices/pci0000:00/usb1/1-2")
+	event := deviceevent.New(deviceevent.Add, d)
+
+	tests := []struct {
+		name    string
+		conf    string
+		wantRan []string
+		wantErr string
+	}{
+		{
+			// In any order, so sorted.
+			name:    "parallel",
+			conf:    "exec = true\nexec = false\nexec = echo",
+			wantRan: []string{"echo", "false", "true"},
+			wantErr: "failed at step 2 (%s:3): exit status 1",
+		},
+		{
+			name:    "stop",
+			conf:    "mode = sequential\nexec = true\nexec = false\nexec = echo",
+			wantRan: []string{"true", "false"},
+			wantErr: "failed at step 2 (%s:4): exit status 1, 1 remaining step(s) skipped",
+		},
+		{
+			name:    "continue",
+			conf:    "mode = sequential\non_error = continue\nexec = false\nexec = echo",
+			wantRan: []string{"false", "echo"},
+			wantErr: "failed at step 1 (%s:4): exit status 1",
+		},
+		{
+			name:    "config order",
+			conf:    "mode = sequential\non_error = continue\nargv = [\"echo\"]\nexec = true\nargv = [\"false\"]\nexec = echo",
+			wantRan: []string{"echo", "true", "false", "echo"},
+			wantErr: "failed at step 3 (%s:6): exit status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullpath := writeConf(t, "[action]\n"+tt.conf+"\n")
+			actions, err := NewActionsFromFile(fullpath, nil)
+			if err != nil {
+				t.Fatalf("NewActionsFromFile() error = %v", err)
+			}
+
+			ex := &fakeExecutor{}
+			err = actions[0].Do(context.Background(), event, ex)
+			if actions[0].mode != modeSequential {
+				sort.Strings(ex.ran)
+			}
+
+			if !reflect.DeepEqual(ex.ran, tt.wantRan) {
+				t.Errorf("Do() ran %v, want %v", ex.ran, tt.wantRan)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Do() error = %v", err)
+			}
+			if want := fmt.Sprintf(tt.wantErr, fullpath); tt.wantErr != "" &&
+				(err == nil || !strings.HasSuffix(err.Error(), want)) {
+				t.Errorf("Do() error = %v, want ...%v", err, want)
+			}
+		})
+	}
+}
+
+func Test_NewActionsFromFileStepOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		include string
+		vars    Vars
+		want    []string
+		// Where the last command is defined, after the file path.
+		wantOrigin string
+	}{
+		{
+			name:       "vars",
+			file:       "test.conf",
+			content:    "[action]\nmode = sequential\nexec = mount\nargv = [\"sync\"]\nexec = rsync ${DEST}\n",
+			vars:       Vars{"DEST": "/srv"},
+			want:       []string{"mount", "sync", "rsync /srv"},
+			wantOrigin: ":5",
+		},
+		{
+			name:       "template",
+			file:       "test.conf",
+			content:    "include = common.inc\n[action]\nuse = steps(n=1)\n",
+			include:    "[template \"steps\"]\nparams = n\nexec = first ${n}\nargv = [\"second\"]\nexec = third\n",
+			want:       []string{"first '1'", "second", "third"},
+			wantOrigin: "common.inc:5",
+		},
+		{
+			name:    "toml",
+			file:    "test.toml",
+			content: "[action]\nexec = \"zero\"\nargv = [\"one\"]\nscript = \"two\"\n",
+			want:    []string{"zero", "one", DefaultInterpreter},
+		},
+		{
+			name:    "json",
+			file:    "test.json",
+			content: `{"action": {"exec": "zero", "argv": ["one"], "script": "two"}}`,
+			want:    []string{"zero", "one", DefaultInterpreter},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fullpath := path.Join(dir, tt.file)
+			if err := os.WriteFile(fullpath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.include != "" {
+				err := os.WriteFile(path.Join(dir, "common.inc"), []byte(tt.include), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			actions, err := NewActionsFromFile(fullpath, tt.vars)
+			if err != nil {
+				t.Fatalf("NewActionsFromFile() error = %v", err)
+			}
+			event := deviceevent.New(deviceevent.Add, device.New("/devices/usb1"))
+			commands, err := actions[0].commands(context.Background(), event)
+			if err != nil {
+				t.Fatalf("commands() error = %v", err)
+			}
+
+			var got []string
+			for _, c := range commands {
+				got = append(got, c.Args[len(c.Args)-1])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands() = %v, want %v", got, tt.want)
+			}
+			if origin := commands[len(commands)-1].Origin; !strings.HasSuffix(origin, tt.wantOrigin) {
+				t.Errorf("origin = %v, want ...%v", origin, tt.wantOrigin)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package action
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"onplugd/utils"
+)
+
+// argv is a command given as an argument vector, which runs without a shell.
+type argv struct {
+	args   []string
+	origin string
+}
+
+// parseArgv parses an argv value, which is a list of strings such as
+// ["xinput", "list"].
+func parseArgv(value string) ([]string, error) {
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, fmt.Errorf(
+			`invalid argv: expected a list such as ["command", "argument"], got '%s'`,
+			value)
+	}
+	if len(args) == 0 || args[0] == "" {
+		return nil, fmt.Errorf("invalid argv: no command in '%s'", value)
+	}
+	return args, nil
+}
+
+// encodeArgv is the reverse of parseArgv.
+func encodeArgv(args []string) string {
+	value, _ := json.Marshal(args)
+	return string(value)
+}
+
+// expandArgv expands the variables, and a leading ~ or ~user/, in each
+// argument of an argv value, so that their values don't need any escaping.
+func (v Vars) expandArgv(value string) (string, error) {
+	args, err := parseArgv(value)
+	if err != nil {
+		// Reported when loading the action.
+		return value, nil
+	}
+
+	for i, arg := range args {
+		if args[i], err = v.Expand(arg); err != nil {
+			return "", err
+		}
+		args[i] = utils.Expand(args[i])
+	}
+
+	return encodeArgv(args), nil
+}
+
+// substitute replaces the ${ONPLUGD_*} references in each of the given
+// arguments with their value in the given environment. Each argument stays a
+// single argument whatever the values contain.
+func substitute(args []string, env []string) []string {
+
+	values := make(map[string]string)
+	for _, keyvalue := range env {
+		if kv := strings.SplitN(keyvalue, "=", 2); len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+
+	substituted := make([]string, len(args))
+	for i, arg := range args {
+		substituted[i] = variableRegexp.ReplaceAllStringFunc(arg, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			if strings.HasPrefix(ref, "$$") || !strings.HasPrefix(name, runtimePrefix) {
+				return ref
+			}
+			return values[name]
+		})
+	}
+
+	return substituted
+}
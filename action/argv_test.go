@@ -0,0 +1,42 @@
+package action
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_NewActionsFromFileArgv(t *testing.T) {
+	t.Setenv("TEST_PROP", "Device Accel Speed")
+
+	fullpath := writeConf(t, `[action]
+argv = ["/usr/bin/xinput", "set-prop", "${ONPLUGD_ATTR_NAME}", "${TEST_PROP}", "-0.5"]
+argv = ["true"]
+`)
+
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	a := actions[0]
+
+	if len(a.argvs) != 2 {
+		t.Fatalf("argvs = %v, want 2 of them", a.argvs)
+	}
+	if got := a.argvs[0].origin; got != fullpath+":2" {
+		t.Errorf("argv origin = %v, want %v:2", got, fullpath)
+	}
+
+	env := []string{"ONPLUGD_ATTR_NAME=Logitech USB Receiver; rm -rf ~"}
+	want := []string{"/usr/bin/xinput", "set-prop",
+		"Logitech USB Receiver; rm -rf ~", "Device Accel Speed", "-0.5"}
+	if got := substitute(a.argvs[0].args, env); !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute() = %q, want %q", got, want)
+	}
+
+	for _, value := range []string{`xinput list`, `[]`, `[1, 2]`} {
+		fullpath := writeConf(t, "[action]\nargv = "+value+"\n")
+		if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+			t.Errorf("NewActionsFromFile() accepted 'argv = %s'", value)
+		}
+	}
+}
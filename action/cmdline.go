@@ -0,0 +1,318 @@
+package action
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+
+	"onplugd/deviceevent"
+)
+
+// commandData is what command line templates such as
+// `notify-send "{{.Device.Attrs.product}} plugged"` get to see.
+type commandData struct {
+	Event  string
+	Device commandDevice
+	// Parents are the devpaths of the parents of the device, closest first.
+	Parents []string
+	// Alias is the modalias of the device, if it has one.
+	Alias string
+}
+
+type commandDevice struct {
+	Path      string
+	Subsystem string
+	Type      string
+	Driver    string
+	Attrs     map[string]string
+	Uevent    map[string]string
+}
+
+func newCommandData(event deviceevent.IDeviceEvent) commandData {
+	d := event.Device()
+
+	var parents []string
+	for p := path.Dir(d.Path()); p != "/devices" && p != "/" && p != "."; p = path.Dir(p) {
+		parents = append(parents, p)
+	}
+
+	return commandData{
+		Event: strings.ToUpper(string(event.Event())),
+		Device: commandDevice{
+			Path:      d.Path(),
+			Subsystem: d.Subsystem(),
+			Type:      d.Type(),
+			Driver:    d.Driver(),
+			Attrs:     d.Attrs(),
+			Uevent:    d.Uevent(),
+		},
+		Parents: parents,
+		Alias:   d.Uevent()["MODALIAS"],
+	}
+}
+
+// rawString is a value that is inserted as is in a command line, without
+// quoting, such as {{raw .Device.Attrs.options}}.
+type rawString string
+
+// quoting is where a value gets inserted in a shell command line.
+type quoting uint8
+
+const (
+	unquoted quoting = iota
+	singleQuoted
+	doubleQuoted
+)
+
+// quoters are the functions that quote values for each context. Every value
+// inserted in a command line template goes through one of them.
+var quoters = map[quoting]string{
+	unquoted:     "_quote",
+	singleQuoted: "_quote_single",
+	doubleQuoted: "_quote_double",
+}
+
+// shellQuote quotes a value for each context of a shell command line.
+var shellQuote = map[quoting]func(string) string{
+	unquoted: func(value string) string {
+		return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+	},
+	singleQuoted: func(value string) string {
+		return strings.ReplaceAll(value, "'", `'\''`)
+	},
+	doubleQuoted: strings.NewReplacer(
+		`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace,
+}
+
+var commandFuncs = texttemplate.FuncMap{
+	"raw": func(value interface{}) rawString {
+		return rawString(fmt.Sprint(value))
+	},
+	"_quote":        quoter(shellQuote[unquoted]),
+	"_quote_single": quoter(shellQuote[singleQuoted]),
+	"_quote_double": quoter(shellQuote[doubleQuoted]),
+}
+
+func quoter(quote func(string) string) func(...interface{}) string {
+	return func(args ...interface{}) string {
+		if len(args) == 1 {
+			if raw, ok := args[0].(rawString); ok {
+				return string(raw)
+			}
+		}
+		return quote(fmt.Sprint(args...))
+	}
+}
+
+// parseCommand parses a command line template, making sure every value it
+// inserts, including through the templates it defines, gets quoted for the
+// shell. It returns nil if the command line is not a template.
+func parseCommand(cmdline string) (*texttemplate.Template, error) {
+	if !strings.Contains(cmdline, "{{") {
+		return nil, nil
+	}
+
+	t, err := texttemplate.New("exec").Funcs(commandFuncs).
+		Option("missingkey=zero").Parse(cmdline)
+	if err != nil {
+		return nil, err
+	}
+
+	state := unquoted
+	e := escaper{template: t, starts: make(map[string]quoting), ends: make(map[string]quoting)}
+	if err := e.escapeList(t.Tree.Root, &state); err != nil {
+		return nil, err
+	}
+
+	// Catch references to things that don't exist now rather than when a
+	// device shows up, with a device deep enough to have a few parents.
+	sample := commandData{Device: commandDevice{Path: "/devices/sample"}}
+	for i := 0; i < 8; i++ {
+		sample.Parents = append(sample.Parents, sample.Device.Path)
+	}
+	if err := t.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// posixShells are the interpreters whose quoting the command line templates
+// follow.
+var posixShells = map[string]bool{
+	"sh": true, "ash": true, "dash": true, "bash": true, "ksh": true, "mksh": true, "zsh": true,
+}
+
+// isPosixShell reports whether the given interpreter is a POSIX shell.
+func isPosixShell(interpreter []string) bool {
+	return len(interpreter) > 0 && posixShells[path.Base(interpreter[0])]
+}
+
+// meantAsTemplate reports whether the given template node references the event,
+// or inserts a string such as {{"{{"}}. A command line template that does
+// neither is most likely a command line with literal braces, such as an awk
+// program.
+func meantAsTemplate(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if meantAsTemplate(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return meantAsTemplate(n.Pipe)
+	case *parse.IfNode:
+		return meantAsTemplate(n.Pipe) || meantAsTemplate(n.List) || meantAsTemplate(n.ElseList)
+	case *parse.RangeNode:
+		return meantAsTemplate(n.Pipe) || meantAsTemplate(n.List) || meantAsTemplate(n.ElseList)
+	case *parse.WithNode:
+		return meantAsTemplate(n.Pipe) || meantAsTemplate(n.List) || meantAsTemplate(n.ElseList)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if meantAsTemplate(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if meantAsTemplate(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return meantAsTemplate(n.Node)
+	case *parse.TemplateNode, *parse.FieldNode, *parse.VariableNode, *parse.DotNode,
+		*parse.StringNode:
+		return true
+	}
+	return false
+}
+
+// renderCommand renders a command line template for the given event.
+func renderCommand(t *texttemplate.Template, event deviceevent.IDeviceEvent) (string, error) {
+	var cmdline strings.Builder
+	if err := t.Execute(&cmdline, newCommandData(event)); err != nil {
+		return "", err
+	}
+	return cmdline.String(), nil
+}
+
+// escaper adds the quoters to a command line template and the templates it
+// defines.
+type escaper struct {
+	template *texttemplate.Template
+	// The quoting context each defined template gets called in, and the one
+	// it leaves behind, by name.
+	starts map[string]quoting
+	ends   map[string]quoting
+}
+
+// escapeList adds the quoter for the current context at the end of the
+// pipelines that output something, following the quotes of the text in
+// between. Branches are followed in order, which is good enough for command
+// lines. Defined templates get escaped for the context they are called in,
+// which must be the same for all their calls.
+func (e *escaper) escapeList(list *parse.ListNode, state *quoting) error {
+	if list == nil {
+		return nil
+	}
+
+	for _, node := range list.Nodes {
+		var err error
+		switch n := node.(type) {
+		case *parse.TextNode:
+			*state = scanQuotes(n.Text, *state)
+
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) == 0 {
+				quote := parse.NewIdentifier(quoters[*state]).SetPos(n.Pos)
+				n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+					NodeType: parse.NodeCommand,
+					Pos:      n.Pos,
+					Args:     []parse.Node{quote},
+				})
+			}
+
+		case *parse.TemplateNode:
+			err = e.escapeTemplate(n.Name, state)
+
+		case *parse.IfNode:
+			err = e.escapeBranches(n.List, n.ElseList, state)
+
+		case *parse.RangeNode:
+			err = e.escapeBranches(n.List, n.ElseList, state)
+
+		case *parse.WithNode:
+			err = e.escapeBranches(n.List, n.ElseList, state)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *escaper) escapeBranches(list, elseList *parse.ListNode, state *quoting) error {
+	if err := e.escapeList(list, state); err != nil {
+		return err
+	}
+	return e.escapeList(elseList, state)
+}
+
+// escapeTemplate escapes the defined template with the given name, called in
+// the given context, the first time it gets called.
+func (e *escaper) escapeTemplate(name string, state *quoting) error {
+	if start, found := e.starts[name]; found {
+		if start != *state {
+			return fmt.Errorf("template %q is called both inside and outside quotes", name)
+		}
+		*state = e.ends[name]
+		return nil
+	}
+
+	defined := e.template.Lookup(name)
+	if defined == nil || defined.Tree == nil {
+		// Executing it fails anyway.
+		return nil
+	}
+
+	e.starts[name], e.ends[name] = *state, *state
+	if err := e.escapeList(defined.Tree.Root, state); err != nil {
+		return err
+	}
+	e.ends[name] = *state
+	return nil
+}
+
+// scanQuotes returns the quoting context at the end of the given shell text,
+// starting in the given one.
+func scanQuotes(text []byte, state quoting) quoting {
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case state == singleQuoted:
+			if c == '\'' {
+				state = unquoted
+			}
+		case c == '\\':
+			i++
+		case state == doubleQuoted:
+			if c == '"' {
+				state = unquoted
+			}
+		case c == '\'':
+			state = singleQuoted
+		case c == '"':
+			state = doubleQuoted
+		}
+	}
+	return state
+}
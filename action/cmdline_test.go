@@ -0,0 +1,105 @@
+package action
+
+import (
+	"testing"
+
+	"onplugd/device"
+	"onplugd/deviceevent"
+)
+
+func Test_renderCommand(t *testing.T) {
+	d := device.New("/devices/pci0000:00/usb1/1-2")
+	d.SetSubsystem("usb")
+	d.Attrs()["product"] = `Bob's "USB" $(reboot)`
+	d.Uevent()["MODALIAS"] = "usb:v046DpC52B"
+	event := deviceevent.New(deviceevent.Add, d)
+
+	tests := []struct {
+		name    string
+		cmdline string
+		want    string
+	}{
+		{
+			name:    "unquoted",
+			cmdline: `notify-send {{.Device.Attrs.product}} {{.Event}}`,
+			want:    `notify-send 'Bob'\''s "USB" $(reboot)' 'ADD'`,
+		},
+		{
+			name:    "double quoted",
+			cmdline: `notify-send "{{.Device.Attrs.product}} plugged"`,
+			want:    `notify-send "Bob's \"USB\" \$(reboot) plugged"`,
+		},
+		{
+			name:    "single quoted",
+			cmdline: `echo 'product: {{.Device.Attrs.product}}'`,
+			want:    `echo 'product: Bob'\''s "USB" $(reboot)'`,
+		},
+		{
+			name:    "raw and missing",
+			cmdline: `echo {{raw .Alias}} {{.Device.Attrs.nope}} {{index .Parents 0}}`,
+			want:    `echo usb:v046DpC52B '' '/devices/pci0000:00/usb1'`,
+		},
+		{
+			name:    "defined",
+			cmdline: `{{define "product"}}{{.Device.Attrs.product}}{{end}}echo {{template "product" .}} {{template "product" .}}`,
+			want:    `echo 'Bob'\''s "USB" $(reboot)' 'Bob'\''s "USB" $(reboot)'`,
+		},
+		{
+			name:    "block",
+			cmdline: `echo "{{block "product" .}}{{.Device.Attrs.product}}{{end}}"`,
+			want:    `echo "Bob's \"USB\" \$(reboot)"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseCommand(tt.cmdline)
+			if err != nil {
+				t.Fatalf("parseCommand() error = %v", err)
+			}
+			got, err := renderCommand(tmpl, event)
+			if err != nil {
+				t.Fatalf("renderCommand() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("renderCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, cmdline := range []string{
+		`echo {{.Device.Atrs.product}}`,
+		`echo {{.Event`,
+		`{{define "p"}}{{.Event}}{{end}}echo {{template "p" .}} '{{template "p" .}}'`,
+	} {
+		fullpath := writeConf(t, "[action]\nexec = "+cmdline+"\n")
+		if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+			t.Errorf("NewActionsFromFile() accepted 'exec = %s'", cmdline)
+		}
+	}
+}
+
+func Test_NewActionsFromFileTemplateInterpreter(t *testing.T) {
+	fullpath := writeConf(t, "[action]\ninterpreter = python3\nexec = print({{.Event}})\n")
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() accepted a template for python3")
+	}
+
+	fullpath = writeConf(t, "[action]\ninterpreter = /bin/bash -e\nexec = echo {{.Event}}\n")
+	if _, err := NewActionsFromFile(fullpath, nil); err != nil {
+		t.Errorf("NewActionsFromFile() error = %v", err)
+	}
+}
+
+func Test_LintLiteralBraces(t *testing.T) {
+	for cmdline, want := range map[string]int{
+		`awk '{{print}}'`:  1,
+		`echo {{"{{"}}x}}`: 0,
+		`echo {{.Event}}`:  0,
+	} {
+		fullpath := writeConf(t, "[action]\nexec = "+cmdline+"\n")
+		got := Lint(fullpath, nil)
+		if len(got) != want || (want > 0 && got[0].Severity != Warning) {
+			t.Errorf("Lint(exec = %s) = %v, want %d warning(s)", cmdline, got, want)
+		}
+	}
+}
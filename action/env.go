@@ -0,0 +1,213 @@
+package action
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"onplugd/deviceevent"
+)
+
+// hexPrefix marks the hex-encoded values.
+const hexPrefix = "hex:"
+
+// envName turns an attribute or property name into a valid environment
+// variable name, with the given prefix.
+func envName(prefix string, name string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return unicode.ToUpper(r)
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// envValue encodes a value so that it can be safely passed around as text.
+func envValue(value string) string {
+	printable := utf8.ValidString(value) && !strings.HasPrefix(value, hexPrefix)
+	for _, r := range value {
+		printable = printable && (unicode.IsPrint(r) || r == '\t' || r == '\n')
+	}
+
+	if printable {
+		return value
+	}
+	return hexPrefix + hex.EncodeToString([]byte(value))
+}
+
+// defaultPath is the PATH of commands run with a clean environment when the
+// daemon has none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// baseEnv returns the environment commands start from: the daemon's, or only
+// its PATH and HOME with clean_env, so that its secrets and session variables
+// don't leak into every command. The ONPLUGD_* variables of the daemon's own
+// environment are not passed on either way.
+func baseEnv(clean bool) []string {
+	if clean {
+		path, found := os.LookupEnv("PATH")
+		if !found {
+			path = defaultPath
+		}
+		env := []string{"PATH=" + path}
+		if home, found := os.LookupEnv("HOME"); found {
+			env = append(env, "HOME="+home)
+		}
+		return env
+	}
+
+	var env []string
+	for _, keyvalue := range os.Environ() {
+		if !strings.HasPrefix(keyvalue, runtimePrefix) {
+			env = append(env, keyvalue)
+		}
+	}
+	return env
+}
+
+// eventEnv returns the environment of the commands run for the given event,
+// which gets the details of the event on top of the given base environment:
+//
+//	ONPLUGD_EVENT      the event, such as ADD or REMOVE
+//	ONPLUGD_PATH       the devpath of the device
+//	ONPLUGD_SUBSYSTEM  its subsystem
+//	ONPLUGD_DRIVER     its driver, if any
+//	ONPLUGD_TYPE       its type, if any
+//	ONPLUGD_ATTR_*     its sysfs attributes
+//	ONPLUGD_UEVENT_*   its uevent properties
+//
+// Attribute and property names are upper-cased, and any character other than
+// a letter, a digit or an underscore becomes an underscore, so that
+// power/control is ONPLUGD_ATTR_POWER_CONTROL. Values that are not printable
+// UTF-8 text, such as binary descriptors, are hex-encoded with a "hex:"
+// prefix, and so are the values that happen to start with "hex:".
+func eventEnv(event deviceevent.IDeviceEvent, base []string) []string {
+	env := base[:len(base):len(base)]
+
+	d := event.Device()
+	env = append(env, "ONPLUGD_EVENT="+strings.ToUpper(string(event.Event())))
+	env = append(env, "ONPLUGD_PATH="+envValue(d.Path()))
+	env = append(env, "ONPLUGD_SUBSYSTEM="+envValue(d.Subsystem()))
+
+	if driver := d.Driver(); driver != "" {
+		env = append(env, "ONPLUGD_DRIVER="+envValue(driver))
+	}
+
+	if typ := d.Type(); typ != "" {
+		env = append(env, "ONPLUGD_TYPE="+envValue(typ))
+	}
+
+	// Sorted, so that collisions between sanitized names are at least
+	// resolved the same way every time.
+	for _, attr := range sortedStringKeys(d.Attrs()) {
+		env = append(env, envName("ONPLUGD_ATTR_", attr)+"="+envValue(d.Attrs()[attr]))
+	}
+
+	for _, uevent := range sortedStringKeys(d.Uevent()) {
+		env = append(env, envName("ONPLUGD_UEVENT_", uevent)+"="+envValue(d.Uevent()[uevent]))
+	}
+
+	return env
+}
+
+// eventPayload is what commands get on their standard input with stdin = json.
+// Values are encoded the same way as in the environment.
+type eventPayload struct {
+	Event   string        `json:"event"`
+	Action  string        `json:"action"`
+	Time    time.Time     `json:"time"`
+	Device  devicePayload `json:"device"`
+	Parents []string      `json:"parents"`
+	Alias   string        `json:"alias,omitempty"`
+}
+
+type devicePayload struct {
+	Path      string            `json:"path"`
+	Subsystem string            `json:"subsystem"`
+	Type      string            `json:"type,omitempty"`
+	Driver    string            `json:"driver,omitempty"`
+	Attrs     map[string]string `json:"attrs"`
+	Uevent    map[string]string `json:"uevent"`
+}
+
+// eventJSON returns the JSON payload for the given event and action.
+func eventJSON(event deviceevent.IDeviceEvent, label string) ([]byte, error) {
+	data := newCommandData(event)
+
+	encode := func(m map[string]string) map[string]string {
+		encoded := make(map[string]string)
+		for k, v := range m {
+			encoded[k] = envValue(v)
+		}
+		return encoded
+	}
+
+	payload := eventPayload{
+		Event:  data.Event,
+		Action: label,
+		Time:   time.Now(),
+		Device: devicePayload{
+			Path:      envValue(data.Device.Path),
+			Subsystem: envValue(data.Device.Subsystem),
+			Type:      envValue(data.Device.Type),
+			Driver:    envValue(data.Device.Driver),
+			Attrs:     encode(data.Device.Attrs),
+			Uevent:    encode(data.Device.Uevent),
+		},
+		Parents: data.Parents,
+		Alias:   envValue(data.Alias),
+	}
+	if payload.Parents == nil {
+		payload.Parents = []string{}
+	}
+
+	return json.Marshal(payload)
+}
+
+// envNameRegexp matches the names that env = NAME=value may set.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnv parses an env value, in the form NAME=value.
+func parseEnv(value string) (string, string, error) {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || !envNameRegexp.MatchString(kv[0]) {
+		return "", "", fmt.Errorf("invalid env: expected NAME=value, got '%s'", value)
+	}
+	if strings.HasPrefix(kv[0], runtimePrefix) {
+		return "", "", fmt.Errorf("invalid env: %s* variables are reserved, got '%s'",
+			runtimePrefix, value)
+	}
+	return kv[0], kv[1], nil
+}
+
+// setEnv sets the given variable in the given environment, replacing any
+// previous value.
+func setEnv(env []string, name string, value string) []string {
+	var result []string
+	for _, keyvalue := range env {
+		if !strings.HasPrefix(keyvalue, name+"=") {
+			result = append(result, keyvalue)
+		}
+	}
+	return append(result, name+"="+value)
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
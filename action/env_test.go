@@ -0,0 +1,59 @@
+package action
+
+import (
+	"encoding/json"
+	"testing"
+
+	"onplugd/device"
+	"onplugd/deviceevent"
+)
+
+func Test_envValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "text", value: "USB Receiver", want: "USB Receiver"},
+		{name: "utf-8", value: "Clé USB", want: "Clé USB"},
+		{name: "binary", value: "\x12\x01\x00\x02", want: "hex:12010002"},
+		{name: "invalid utf-8", value: "a\xffb", want: "hex:61ff62"},
+		{name: "prefix", value: "hex:00", want: "hex:6865783a3030"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := envValue(tt.value); got != tt.want {
+				t.Errorf("envValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := envName("ONPLUGD_ATTR_", "power/control"); got != "ONPLUGD_ATTR_POWER_CONTROL" {
+		t.Errorf("envName() = %v, want ONPLUGD_ATTR_POWER_CONTROL", got)
+	}
+}
+
+func Test_eventJSON(t *testing.T) {
+	d := device.New("/devices/pci0000:00/usb1/1-2")
+	d.SetSubsystem("usb")
+	d.Attrs()["descriptors"] = "\x12\x01"
+	d.Attrs()["product"] = "USB Receiver"
+	d.Uevent()["MODALIAS"] = "usb:v046DpC52B"
+
+	payload, err := eventJSON(deviceevent.New(deviceevent.Add, d), "test.conf")
+	if err != nil {
+		t.Fatalf("eventJSON() error = %v", err)
+	}
+
+	var got eventPayload
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("eventJSON() returned invalid JSON: %v", err)
+	}
+
+	if got.Event != "ADD" || got.Action != "test.conf" || got.Alias != "usb:v046DpC52B" ||
+		got.Device.Attrs["descriptors"] != "hex:1201" ||
+		got.Device.Attrs["product"] != "USB Receiver" ||
+		len(got.Parents) != 2 || got.Parents[0] != "/devices/pci0000:00/usb1" {
+		t.Errorf("eventJSON() = %s", payload)
+	}
+}
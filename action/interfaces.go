@@ -1,6 +1,9 @@
 package action
 
 import (
+	"context"
+	"time"
+
 	"onplugd/deviceevent"
 	"onplugd/executor"
 )
@@ -9,5 +12,15 @@ import (
 // result of a device event.
 type IAction interface {
 	Match(deviceevent.IDeviceEvent) bool
-	Do(deviceevent.IDeviceEvent, executor.IExecutor) error
+	Explain(deviceevent.IDeviceEvent) MatchTrace
+	Do(context.Context, deviceevent.IDeviceEvent, executor.IExecutor) error
+	RunsWhilePresent() bool
+	RunWhilePresent(context.Context, deviceevent.IDeviceEvent, executor.IExecutor) error
+	Priority() int
+	Final() bool
+	Concurrency() string
+	Lock() string
+	Delay() time.Duration
+	Cooldown() time.Duration
+	RateLimit() (int, time.Duration)
 }
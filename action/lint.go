@@ -0,0 +1,426 @@
+package action
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/utils"
+)
+
+// Severity is the severity of a config diagnostic.
+type Severity uint8
+
+const (
+	// Warning is for config issues that don't prevent the config from loading.
+	Warning Severity = iota
+	// Error is for config issues that make the config unusable.
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic describes an issue found in a config file.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.File, d.Severity, d.Message)
+}
+
+// ConfigError is the error returned when a config file has errors.
+type ConfigError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *ConfigError) Error() string {
+	var lines []string
+	for _, d := range e.Diagnostics {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// schema lists the sections a config file may contain, and the keys each of
+// them may contain.
+var schema = map[string][]string{
+	topLevel: {"include"},
+	"match":  {"event", "path", "subsystem", "type", "driver", "attr", "uevent"},
+	"action": {"use", "exec", "argv", "script", "interpreter", "stdin", "mode", "on_error", "timeout", "kill_after",
+		"retries", "retry_backoff", "retry_on", "user", "group", "groups",
+		"workdir", "env", "clean_env", "concurrency", "lock",
+		"delay", "cooldown", "rate_limit", "run_while_present", "priority", "final"},
+}
+
+func init() {
+	// Templates can hold anything that goes into an action and its match,
+	// except for the use of another template.
+	keys := []string{"params"}
+	keys = append(keys, schema["match"]...)
+	for _, key := range schema["action"] {
+		if key != "use" {
+			keys = append(keys, key)
+		}
+	}
+	schema["template"] = keys
+}
+
+// knownEvents lists the events that can be matched against.
+var knownEvents = []deviceevent.Event{
+	deviceevent.Add,
+	deviceevent.Remove,
+	deviceevent.Bind,
+	deviceevent.Unbind,
+	deviceevent.Change,
+	deviceevent.Move,
+	deviceevent.Coldplug,
+}
+
+// Shell builtins and keywords that an exec line may start with, and that are
+// not expected to be found in PATH.
+var shellBuiltins = []string{
+	".", ":", "[", "alias", "break", "case", "cd", "command", "continue",
+	"eval", "exec", "exit", "export", "for", "if", "read", "return", "set",
+	"shift", "source", "test", "trap", "ulimit", "umask", "unset", "until",
+	"wait", "while", "{", "(", "!",
+}
+
+// Lint loads the given config file and returns all the issues found in it,
+// ordered by line.
+func Lint(fullpath string, vars Vars) []Diagnostic {
+	_, diagnostics := load(fullpath, vars)
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+
+	return diagnostics
+}
+
+// linter accumulates the diagnostics for a config file.
+type linter struct {
+	file        string
+	lines       []iniLine
+	diagnostics []Diagnostic
+}
+
+func newLinter(fullpath string) *linter {
+	return &linter{file: fullpath}
+}
+
+func (l *linter) report(severity Severity, line int, format string, args ...interface{}) {
+	l.diagnostics = append(l.diagnostics, Diagnostic{
+		File:     l.file,
+		Line:     line,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// failed reports whether errors were reported.
+func (l *linter) failed() bool {
+	for _, d := range l.diagnostics {
+		if d.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionLine returns the line where the given section starts, or 0 if not
+// found.
+func (l *linter) sectionLine(section string) int {
+	for _, line := range l.lines {
+		if line.section == section && line.key == "" {
+			return line.number
+		}
+	}
+	return 0
+}
+
+// keyLine returns the line where the given key has the given value, or the
+// line where the key first appears if no value is given. It falls back on the
+// section's line if the key is not found.
+func (l *linter) keyLine(section string, key string, value string) int {
+	for _, line := range l.lines {
+		if line.section == section && line.key == key &&
+			strings.Contains(line.value, value) {
+			return line.number
+		}
+	}
+	return l.sectionLine(section)
+}
+
+// checkSchema reports the sections and keys that are not part of the schema.
+func (l *linter) checkSchema(doc *document) {
+	for _, section := range doc.sections {
+		kind, name := parseSectionName(section.name)
+		keys, known := schema[kind]
+		if !known || (kind == topLevel && name != "") {
+			l.report(Error, l.sectionLine(section.name),
+				"unknown section [%s]%s", section.name,
+				suggest(kind, schemaSections()))
+			continue
+		}
+
+		for _, key := range section.keys {
+			if !contains(keys, key) {
+				where := fmt.Sprintf("section [%s]", section.name)
+				if section.name == topLevel {
+					where = "the top level, outside of any section"
+				}
+				l.report(Error, l.keyLine(section.name, key, ""),
+					"unknown key '%s' in %s%s", key, where, suggest(key, keys))
+			}
+		}
+	}
+}
+
+// checkExecs reports empty exec lines in the given section, and those whose
+// command can't be found. Actions need exec lines unless they have other
+// commands.
+func (l *linter) checkExecs(section string, execs []string, scripted bool) {
+	empty := false
+	for _, line := range l.lines {
+		if line.section == section && line.key == "exec" && line.value == "" {
+			l.report(Error, line.number, "empty exec line")
+			empty = true
+		}
+	}
+
+	if len(execs) == 0 && !empty && !scripted {
+		l.report(Error, l.sectionLine(section),
+			"no exec, argv, script or run_while_present in [%s], this action does nothing", section)
+		return
+	}
+
+	for _, cmdline := range execs {
+		fields := strings.Fields(utils.Expand(cmdline))
+		if len(fields) == 0 {
+			continue
+		}
+
+		command := fields[0]
+		if contains(shellBuiltins, command) ||
+			strings.Contains(command, "=") || strings.ContainsAny(command, "$`\"'") ||
+			strings.Contains(command, "{{") {
+			// Builtins, variable assignments, shell expansions and templates
+			// are beyond what we can check.
+			continue
+		}
+
+		if _, err := exec.LookPath(command); err != nil {
+			l.report(Warning, l.keyLine(section, "exec", cmdline),
+				"command '%s' not found in PATH", command)
+		}
+	}
+}
+
+// checkArgv reports an argv whose command can't be found.
+func (l *linter) checkArgv(line int, args []string) {
+	command := utils.Expand(args[0])
+	if strings.Contains(command, "${") {
+		// Only known at run time.
+		return
+	}
+
+	if _, err := exec.LookPath(command); err != nil {
+		l.report(Warning, line, "command '%s' not found in PATH", command)
+	}
+}
+
+// checkInterpreter reports an empty interpreter, or one that can't be found.
+func (l *linter) checkInterpreter(section string, value string, interpreter []string) {
+	line := l.keyLine(section, "interpreter", value)
+	if len(interpreter) == 0 {
+		l.report(Error, line, "empty interpreter")
+		return
+	}
+
+	if _, err := exec.LookPath(interpreter[0]); err != nil {
+		l.report(Warning, line, "interpreter '%s' not found in PATH", interpreter[0])
+	}
+}
+
+// choice returns the last value of the given setting, reporting values that
+// are not among the given choices. It returns an empty string if the setting
+// is not there, or is invalid.
+func (l *linter) choice(section string, key string, s settings, choices ...string) string {
+	values := s[key]
+	if len(values) == 0 {
+		return ""
+	}
+
+	value := values[len(values)-1]
+	if !contains(choices, value) {
+		l.report(Error, l.keyLine(section, key, value),
+			"invalid %s: expected one of %v, got '%s'%s",
+			key, choices, value, suggest(value, choices))
+		return ""
+	}
+	return value
+}
+
+// duration parses the last value of the given duration setting, such as
+// "30s", reporting invalid ones. It returns 0 if the setting is not there.
+func (l *linter) duration(section string, key string, s settings) time.Duration {
+	values := s[key]
+	if len(values) == 0 {
+		return 0
+	}
+
+	value := values[len(values)-1]
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		l.report(Error, l.keyLine(section, key, value),
+			"invalid %s: expected a positive duration such as 30s, got '%s'", key, value)
+		return 0
+	}
+	return d
+}
+
+// origin returns the location of the given line of the file, for messages.
+func (l *linter) origin(line int) string {
+	if line == 0 {
+		return l.file
+	}
+	return fmt.Sprintf("%s:%d", l.file, line)
+}
+
+// checkMatch reports the match criteria of the given section that can never be
+// met.
+func (l *linter) checkMatch(a *Action, section string) {
+	for _, event := range a.events {
+		known := false
+		for _, e := range knownEvents {
+			known = known || match(event, string(e))
+		}
+		if !known {
+			l.report(Warning, l.keyLine(section, "event", event),
+				"event '%s' never happens, expected one of %v", event, knownEvents)
+		}
+	}
+
+	for _, subsystem := range a.subsystems {
+		monitored := false
+		for _, s := range device.MonitoredSubsystems {
+			monitored = monitored || match(subsystem, s)
+		}
+		if !monitored {
+			l.report(Warning, l.keyLine(section, "subsystem", subsystem),
+				"subsystem '%s' is not monitored, expected one of %v",
+				subsystem, device.MonitoredSubsystems)
+		}
+	}
+}
+
+func schemaSections() []string {
+	var sections []string
+	for section := range schema {
+		if section != topLevel {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// suggest returns a hint about which of the candidates the given misspelled
+// word was meant to be, if any is close enough.
+func suggest(word string, candidates []string) string {
+	for _, candidate := range candidates {
+		if utils.EditDistance(word, candidate) <= 2 {
+			return fmt.Sprintf(" (did you mean '%s'?)", candidate)
+		}
+	}
+	return ""
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, hay := range haystack {
+		if hay == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// iniLine is a section header or key line of an INI file.
+type iniLine struct {
+	number  int
+	section string
+	key     string
+	value   string
+}
+
+// scanLines finds the section headers and keys of the given INI content. It
+// only needs to be good enough to locate things, not to parse values.
+func scanLines(content string) []iniLine {
+
+	var lines []iniLine
+	section := topLevel
+	closing := ""
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+
+		// Skip the remainder of multi-line values.
+		if closing != "" {
+			if strings.Contains(line, closing) {
+				closing = ""
+			}
+			continue
+		}
+
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+			lines = append(lines, iniLine{number: i + 1, section: section})
+			continue
+		}
+
+		keyvalue := strings.SplitN(line, "=", 2)
+		if len(keyvalue) != 2 {
+			keyvalue = strings.SplitN(line, ":", 2)
+		}
+		if len(keyvalue) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(keyvalue[1])
+		for _, quote := range []string{`"""`, "`"} {
+			if strings.HasPrefix(value, quote) &&
+				!strings.Contains(value[len(quote):], quote) {
+				closing = quote
+			}
+		}
+
+		lines = append(lines, iniLine{
+			number:  i + 1,
+			section: section,
+			key:     strings.TrimSpace(keyvalue[0]),
+			value:   value,
+		})
+	}
+
+	return lines
+}
@@ -0,0 +1,94 @@
+package action
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Lint(t *testing.T) {
+	const conf = `exec = foo
+[matc]
+
+[match]
+subsytem = usb
+subsystem = pci
+attr = broken
+event = plug
+
+[action]
+exec =
+exec = sh -c true
+`
+
+	fullpath := writeConf(t, conf)
+
+	type diagnostic struct {
+		line     int
+		severity Severity
+	}
+	want := []diagnostic{
+		{line: 1, severity: Error},
+		{line: 2, severity: Error},
+		{line: 5, severity: Error},
+		{line: 6, severity: Warning},
+		{line: 7, severity: Error},
+		{line: 8, severity: Warning},
+		{line: 11, severity: Error},
+	}
+
+	got := Lint(fullpath, nil)
+	if len(got) != len(want) {
+		t.Fatalf("Lint() returned %d diagnostics, want %d: %v", len(got), len(want), got)
+	}
+	for i, d := range got {
+		if d.Line != want[i].line || d.Severity != want[i].severity {
+			t.Errorf("Lint()[%d] = %v, want line %d, %v",
+				i, d, want[i].line, want[i].severity)
+		}
+	}
+
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() succeeded on an invalid config")
+	}
+}
+
+func Test_LintMissingAction(t *testing.T) {
+	fullpath := writeConf(t, "[match]\nsubsystem = usb\n")
+
+	got := Lint(fullpath, nil)
+	if len(got) != 1 || got[0].Severity != Error {
+		t.Errorf("Lint() = %v, want a single error", got)
+	}
+}
+
+func Test_LintInvalidValues(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "retries = -1", want: "invalid retries: expected a non-negative integer"},
+		{value: "retries = 2\nretry_backoff = 5s..1s", want: "invalid retry_backoff"},
+		{value: "retries = 2\nretry_on = 0", want: "invalid retry_on"},
+		{value: "workdir = tmp", want: "invalid workdir"},
+		{value: "env = LANG", want: "invalid env"},
+		{value: "env = ONPLUGD_PATH=/", want: "invalid env"},
+		{value: "clean_env = maybe", want: "invalid clean_env"},
+		{value: "lock = two words", want: "invalid lock"},
+		{value: "rate_limit = 5", want: "invalid rate_limit"},
+		{value: "rate_limit = 0/min", want: "invalid rate_limit"},
+		{value: "rate_limit = 5/fortnight", want: "invalid rate_limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			fullpath := writeConf(t, "[action]\nexec = true\n"+tt.value+"\n")
+
+			got := Lint(fullpath, nil)
+			if len(got) != 1 || got[0].Severity != Error || !strings.Contains(got[0].Message, tt.want) {
+				t.Errorf("Lint() = %v, want a single error about %s", got, tt.want)
+			}
+			if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+				t.Errorf("NewActionsFromFile() accepted %q", tt.value)
+			}
+		})
+	}
+}
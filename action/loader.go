@@ -0,0 +1,465 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+)
+
+// topLevel is the name of the section holding the keys that are outside of any
+// section.
+var topLevel = ini.DefaultSection
+
+// document is the content of a config file, independently of its format.
+type document struct {
+	sections []*docSection
+	// The lines of the sections and keys, when the format lets us find them.
+	lines []iniLine
+}
+
+// docSection is a section of a config file, such as [action "foo"].
+type docSection struct {
+	name string
+	// The keys of the section in order, including those without a value.
+	keys     []string
+	settings settings
+	// Where the commands of the section are, in the order of the document.
+	positions []position
+}
+
+// position is where a value of one of the commandKeys is in a config file,
+// found when parsing it, before the value gets expanded.
+type position struct {
+	key string
+	// The index of the value among the values of the key.
+	index int
+	file  string
+	// The line of the value, 0 if the format doesn't let us find it.
+	line int
+}
+
+// positionKeys are the keys whose values get a position: those whose order
+// matters, and those whose origin shows up in messages.
+var positionKeys = []string{"exec", "argv", "script", "run_while_present"}
+
+// origin returns where the value is, for messages.
+func (p position) origin() string {
+	if p.line == 0 {
+		return p.file
+	}
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// loader parses the config files of a given format.
+type loader interface {
+	load(fullpath string) (*document, error)
+}
+
+// loaders are the supported config formats, by file extension.
+var loaders = map[string]loader{
+	".conf": iniLoader{},
+	".toml": tomlLoader{},
+	".json": jsonLoader{},
+}
+
+// Patterns returns the file name patterns of the supported config formats.
+func Patterns() []string {
+	var patterns []string
+	for ext := range loaders {
+		patterns = append(patterns, "*"+ext)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// loadDocument parses the given config file with the loader for its
+// extension. Files with other extensions, such as included ones, are INI.
+func loadDocument(fullpath string) (*document, error) {
+	loader, found := loaders[filepath.Ext(fullpath)]
+	if !found {
+		loader = iniLoader{}
+	}
+
+	d, err := loader.load(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range d.sections {
+		for i := range s.positions {
+			s.positions[i].file = fullpath
+		}
+	}
+	return d, nil
+}
+
+// section returns the section with the given name, or nil.
+func (d *document) section(name string) *docSection {
+	for _, s := range d.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// sectionSettings returns a copy of the settings of the given section, which
+// may be nil.
+func sectionSettings(section *docSection) settings {
+	s := make(settings)
+	if section == nil {
+		return s
+	}
+
+	for key, values := range section.settings {
+		s[key] = append([]string(nil), values...)
+	}
+
+	return s
+}
+
+// iniLoader loads INI configs, where keys may be listed multiple times.
+type iniLoader struct{}
+
+func (iniLoader) load(fullpath string) (*document, error) {
+
+	// ShadowLoad (instead of Load) lets us list keys multiple times.
+	conf, err := ini.ShadowLoad(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var d document
+	for _, section := range conf.Sections() {
+		s := docSection{name: section.Name(), settings: make(settings)}
+		for _, key := range section.Keys() {
+			s.keys = append(s.keys, key.Name())
+			if values := loadSliceFromShadow(key.ValueWithShadows()); len(values) > 0 {
+				s.settings[key.Name()] = values
+			}
+		}
+		d.sections = append(d.sections, &s)
+	}
+
+	// The INI parser doesn't keep track of line numbers, so we do our own
+	// lightweight pass on the file to recover them.
+	if content, err := os.ReadFile(fullpath); err == nil {
+		d.lines = scanLines(string(content))
+	}
+	for _, s := range d.sections {
+		s.positions = iniPositions(s, d.lines)
+	}
+
+	return &d, nil
+}
+
+// iniPositions returns the positions of the commands of the given INI section,
+// given the lines of the file. The values of a key match its lines in order,
+// once the lines without a value and the repeated ones, which the INI parser
+// drops, are left out. Failing that, values are looked up by content.
+func iniPositions(s *docSection, lines []iniLine) []position {
+	var positions []position
+	for _, key := range positionKeys {
+		values := s.settings[key]
+
+		var candidates []iniLine
+		seen := make(map[string]bool)
+		for _, line := range lines {
+			if line.section == s.name && line.key == key && line.value != "" && !seen[line.value] {
+				seen[line.value] = true
+				candidates = append(candidates, line)
+			}
+		}
+
+		used := make(map[int]bool)
+		for i, value := range values {
+			p := position{key: key, index: i}
+			if len(candidates) == len(values) {
+				p.line = candidates[i].number
+			} else {
+				first := strings.SplitN(value, "\n", 2)[0]
+				for _, line := range candidates {
+					if !used[line.number] && strings.Contains(line.value, first) {
+						p.line = line.number
+						break
+					}
+				}
+			}
+			used[p.line] = true
+			positions = append(positions, p)
+		}
+	}
+
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positions[i].line < positions[j].line
+	})
+	return positions
+}
+
+// tomlLoader loads TOML configs.
+type tomlLoader struct{}
+
+func (tomlLoader) load(fullpath string) (*document, error) {
+	tree := make(map[string]interface{})
+	meta, err := toml.DecodeFile(fullpath, &tree)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make(keyOrder)
+	for _, key := range meta.Keys() {
+		order.add(key)
+	}
+	return fromTree(tree, order)
+}
+
+// jsonLoader loads JSON configs.
+type jsonLoader struct{}
+
+func (jsonLoader) load(fullpath string) (*document, error) {
+	content, err := os.ReadFile(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]interface{})
+	if err := json.Unmarshal(content, &tree); err != nil {
+		return nil, err
+	}
+
+	order := make(keyOrder)
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if err := order.addJSON(decoder, nil); err != nil {
+		return nil, err
+	}
+	return fromTree(tree, order)
+}
+
+// keyOrder is the position of the keys of a tree in their document, by path.
+type keyOrder map[string]int
+
+func (o keyOrder) add(path []string) {
+	if _, found := o[o.key(path)]; !found {
+		o[o.key(path)] = len(o)
+	}
+}
+
+func (o keyOrder) key(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// addJSON adds the keys of the JSON value the given decoder is at, which is
+// at the given path.
+func (o keyOrder) addJSON(decoder *json.Decoder, path []string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key := append(path[:len(path):len(path)], fmt.Sprint(token))
+			o.add(key)
+			if err := o.addJSON(decoder, key); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for decoder.More() {
+			if err := o.addJSON(decoder, path); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	}
+	return err
+}
+
+// sortedKeys returns the keys of the given table at the given path, in the
+// order of the document.
+func (o keyOrder) sortedKeys(m map[string]interface{}, path ...string) []string {
+	keys := sortedTreeKeys(m)
+	rank := func(key string) int {
+		if r, found := o[o.key(append(path[:len(path):len(path)], key))]; found {
+			return r
+		}
+		return len(o)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return rank(keys[i]) < rank(keys[j]) })
+	return keys
+}
+
+// fromTree converts a config decoded from a format made of nested tables, such
+// as TOML or JSON. Sections are tables, so that {"action": {...}} stands for
+// [action] and {"action": {"foo": {...}}} for [action "foo"]. Values are
+// strings, numbers, booleans or lists of them, attr and uevent may also be
+// tables of values, and argv is a list of arguments or a list of such lists.
+// Keys are taken in the given order.
+func fromTree(tree map[string]interface{}, order keyOrder) (*document, error) {
+
+	top := docSection{name: topLevel, settings: make(settings)}
+	d := document{sections: []*docSection{&top}}
+
+	for _, kind := range order.sortedKeys(tree) {
+		table, isTable := tree[kind].(map[string]interface{})
+		if !isTable {
+			if err := top.add(kind, tree[kind]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		plain := docSection{name: kind, settings: make(settings)}
+		var named []*docSection
+
+		for _, key := range order.sortedKeys(table, kind) {
+			sub, isTable := table[key].(map[string]interface{})
+			if isTable && (kind == "template" || !isMapKey(key)) {
+				s, err := treeSection(sectionName(kind, key), sub, order.sortedKeys(sub, kind, key))
+				if err != nil {
+					return nil, err
+				}
+				named = append(named, s)
+				continue
+			}
+
+			if err := plain.add(key, table[key]); err != nil {
+				return nil, fmt.Errorf("[%s]: %s", kind, err)
+			}
+		}
+
+		if len(plain.keys) > 0 || len(named) == 0 {
+			d.sections = append(d.sections, &plain)
+		}
+		d.sections = append(d.sections, named...)
+	}
+
+	return &d, nil
+}
+
+func treeSection(name string, table map[string]interface{}, keys []string) (*docSection, error) {
+	s := docSection{name: name, settings: make(settings)}
+	for _, key := range keys {
+		if err := s.add(key, table[key]); err != nil {
+			return nil, fmt.Errorf("[%s]: %s", name, err)
+		}
+	}
+	return &s, nil
+}
+
+// add adds the given tree value to the section under the given key.
+func (s *docSection) add(key string, value interface{}) error {
+	s.keys = append(s.keys, key)
+
+	var values []string
+	if list, isList := value.([]interface{}); isList && key == "argv" {
+		// A list of strings is a single argv, and a list of lists several.
+		argvs := []interface{}{list}
+		if len(list) > 0 {
+			if _, nested := list[0].([]interface{}); nested {
+				argvs = list
+			}
+		}
+
+		for _, argv := range argvs {
+			args, err := scalars(argv)
+			if err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+			values = append(values, encodeArgv(args))
+		}
+	} else if table, isTable := value.(map[string]interface{}); isTable && isMapKey(key) {
+		// {"idVendor": "046d"} is a more natural way to write "idVendor=046d".
+		for _, k := range sortedTreeKeys(table) {
+			vs, err := scalars(table[k])
+			if err != nil {
+				return fmt.Errorf("%s.%s: %s", key, k, err)
+			}
+			for _, v := range vs {
+				values = append(values, k+"="+v)
+			}
+		}
+	} else {
+		var err error
+		if values, err = scalars(value); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+
+	if values = loadSliceFromShadow(values); len(values) > 0 {
+		if contains(positionKeys, key) {
+			for i := range values {
+				s.positions = append(s.positions,
+					position{key: key, index: len(s.settings[key]) + i})
+			}
+		}
+		s.settings[key] = append(s.settings[key], values...)
+	}
+	return nil
+}
+
+// scalars converts a tree value that is either a scalar or a list of scalars
+// to strings.
+func scalars(value interface{}) ([]string, error) {
+	if v, ok := scalar(value); ok {
+		return []string{v}, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a value or a list of values, got %T", value)
+	}
+
+	var values []string
+	for _, item := range list {
+		v, ok := scalar(item)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of values, got %T in it", item)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// scalar returns the given value as it would be written in an INI config, if
+// it is a single value. Numbers are written out in full, since JSON has them
+// all as floats, which would otherwise print as 1e+06.
+func scalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool, int64:
+		return fmt.Sprint(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// isMapKey reports whether the given key holds KEY=VALUE entries.
+func isMapKey(key string) bool {
+	return key == "attr" || key == "uevent"
+}
+
+func sortedTreeKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,104 @@
+package action
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func Test_loaders(t *testing.T) {
+	formats := map[string]string{
+		"test.conf": `
+[match "dock"]
+subsystem = usb
+attr = idVendor=17ef
+attr = serial=A
+attr = serial=B
+
+[action "dock"]
+exec = xrandr --auto
+exec = """echo docked
+echo twice"""
+priority = 1000000
+final = true
+`,
+		"test.toml": `
+[match.dock]
+subsystem = "usb"
+attr = { idVendor = "17ef", serial = ["A", "B"] }
+
+[action.dock]
+exec = ["xrandr --auto", """echo docked
+echo twice"""]
+priority = 1000000
+final = true
+`,
+		"test.json": `{
+	"match": {"dock": {"subsystem": "usb", "attr": {"idVendor": "17ef", "serial": ["A", "B"]}}},
+	"action": {"dock": {"exec": ["xrandr --auto", "echo docked\necho twice"], "priority": 1000000, "final": true}}
+}`,
+	}
+
+	dir := t.TempDir()
+	var want *Action
+	for _, name := range []string{"test.conf", "test.toml", "test.json"} {
+		fullpath := path.Join(dir, name)
+		if err := os.WriteFile(fullpath, []byte(formats[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		actions, err := NewActionsFromFile(fullpath, nil)
+		if err != nil {
+			t.Fatalf("%s: NewActionsFromFile() error = %v", name, err)
+		}
+		if len(actions) != 1 {
+			t.Fatalf("%s: NewActionsFromFile() returned %d actions, want 1", name, len(actions))
+		}
+
+		got := actions[0]
+		got.label, got.origins, got.warnings = "", nil, nil
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	fullpath := path.Join(dir, "broken.toml")
+	if err := os.WriteFile(fullpath, []byte("[action]\nexec = [1, [2]]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewActionsFromFile(fullpath, nil); err == nil {
+		t.Errorf("NewActionsFromFile() accepted nested lists")
+	}
+}
+
+func Test_scalars(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{name: "string", value: "xrandr --auto", want: []string{"xrandr --auto"}},
+		{name: "bool", value: true, want: []string{"true"}},
+		{name: "integer", value: int64(1000000), want: []string{"1000000"}},
+		{name: "whole float", value: float64(1000000), want: []string{"1000000"}},
+		{name: "float", value: 0.5, want: []string{"0.5"}},
+		{name: "list", value: []interface{}{"A", float64(2)}, want: []string{"A", "2"}},
+		{name: "nested list", value: []interface{}{[]interface{}{"A"}}, wantErr: true},
+		{name: "table", value: map[string]interface{}{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scalars(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scalars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scalars() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
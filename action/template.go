@@ -0,0 +1,308 @@
+package action
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"onplugd/utils"
+)
+
+// template is a reusable set of match and action settings, defined in a
+// [template "name"] section. Its values may contain ${param} placeholders for
+// the parameters it declares, which get replaced when the template is used,
+// quoted as needed, see fillParams.
+type template struct {
+	name   string
+	params []string
+	values settings
+	// The files included on the way from the config to the template, the last
+	// being the one it is defined in, and where its commands are in it.
+	files     []string
+	positions []position
+}
+
+// instance is a template with its parameters substituted.
+type instance struct {
+	values    settings
+	files     []string
+	positions []position
+}
+
+var useRegexp = regexp.MustCompile(`^\s*([\w.-]+)\s*(?:\((.*)\))?\s*$`)
+var placeholderRegexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// loadTemplates collects the templates defined in the given config and in the
+// files it includes, recursively. The given chain lists the files included on
+// the way to the document, which is the last of them unless it is the config.
+func loadTemplates(
+	l *linter, doc *document, fullpath string, chain []string,
+	templates map[string]*template, visited map[string]bool) {
+
+	for _, section := range doc.sections {
+		kind, name := parseSectionName(section.name)
+		if kind != "template" {
+			continue
+		}
+
+		t := template{
+			name: name, values: sectionSettings(section), files: chain, positions: section.positions}
+		for _, params := range t.values["params"] {
+			for _, param := range strings.Split(params, ",") {
+				if param = strings.TrimSpace(param); param != "" {
+					t.params = append(t.params, param)
+				}
+			}
+		}
+		delete(t.values, "params")
+
+		templates[name] = &t
+	}
+
+	for _, include := range sectionSettings(doc.section(topLevel))["include"] {
+		line := l.keyLine(topLevel, "include", include)
+		included := resolveInclude(fullpath, include)
+
+		if visited[included] {
+			l.report(Error, line, "circular include of %s", included)
+			continue
+		}
+
+		inc, err := loadDocument(included)
+		if err != nil {
+			l.report(Error, line, "can't include %s: %s", include, err)
+			continue
+		}
+
+		// Issues in included files are reported against those files.
+		sub := newLinter(included)
+		sub.lines = inc.lines
+		sub.checkSchema(inc)
+		for _, section := range inc.sections {
+			kind, _ := parseSectionName(section.name)
+			if kind != "template" && kind != topLevel {
+				sub.report(Error, sub.sectionLine(section.name),
+					"only templates can be defined in included files")
+			}
+		}
+		l.diagnostics = append(l.diagnostics, sub.diagnostics...)
+
+		visited[included] = true
+		loadTemplates(l, inc, included, append(chain[:len(chain):len(chain)], included),
+			templates, visited)
+		delete(visited, included)
+	}
+}
+
+// instantiate parses a template use such as "name(param=value, ...)" and
+// returns the corresponding instance, or nil if it is invalid. Issues are
+// reported against the given line.
+func instantiate(
+	l *linter, line int, templates map[string]*template, use string) *instance {
+
+	parts := useRegexp.FindStringSubmatch(use)
+	if parts == nil {
+		l.report(Error, line,
+			"invalid template use: expected NAME(PARAM=VALUE, ...), got '%s'", use)
+		return nil
+	}
+
+	t, found := templates[parts[1]]
+	if !found {
+		l.report(Error, line, "unknown template '%s'", parts[1])
+		return nil
+	}
+
+	args := make(map[string]string)
+	for _, arg := range splitArgs(parts[2]) {
+		keyvalue := strings.SplitN(arg, "=", 2)
+		if len(keyvalue) != 2 {
+			l.report(Error, line,
+				"invalid template argument: expected PARAM=VALUE, got '%s'", arg)
+			return nil
+		}
+
+		k := strings.TrimSpace(keyvalue[0])
+		if !contains(t.params, k) {
+			l.report(Error, line,
+				"template '%s' has no parameter '%s'%s", t.name, k, suggest(k, t.params))
+			return nil
+		}
+		args[k] = unquote(strings.TrimSpace(keyvalue[1]))
+	}
+
+	for _, param := range t.params {
+		if _, found := args[param]; !found {
+			l.report(Error, line,
+				"missing argument '%s' for template '%s'", param, t.name)
+			return nil
+		}
+	}
+
+	i := instance{values: make(settings), files: t.files, positions: t.positions}
+	for key, values := range t.values {
+		for _, value := range values {
+			i.values[key] = append(i.values[key], fillParams(key, value, args))
+		}
+	}
+
+	return &i
+}
+
+// fillParams replaces the ${param} placeholders in a value of the given key
+// with the given arguments, quoted for where they land: for a POSIX shell in
+// commands, and as a JSON string in argv values, so that they can't run
+// anything or change the arguments. Other ${...} are left alone, to be
+// expanded as variables.
+func fillParams(key string, value string, args map[string]string) string {
+
+	var filled strings.Builder
+	shell, inString := unquoted, false
+	last := 0
+
+	for _, match := range placeholderRegexp.FindAllStringSubmatchIndex(value, -1) {
+		text := value[last:match[0]]
+		filled.WriteString(text)
+		shell = scanQuotes([]byte(text), shell)
+		inString = scanJSONString(text, inString)
+		last = match[1]
+
+		arg, found := args[value[match[2]:match[3]]]
+		switch {
+		case !found:
+			filled.WriteString(value[match[0]:match[1]])
+		case commandKeys[key]:
+			filled.WriteString(shellQuote[shell](arg))
+		case key == "argv":
+			quoted, _ := json.Marshal(arg)
+			if inString {
+				quoted = quoted[1 : len(quoted)-1]
+			}
+			filled.Write(quoted)
+		default:
+			filled.WriteString(arg)
+		}
+	}
+	filled.WriteString(value[last:])
+
+	return filled.String()
+}
+
+// scanJSONString reports whether the end of the given JSON text is within a
+// string, starting within one or not.
+func scanJSONString(text string, inString bool) bool {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		}
+	}
+	return inString
+}
+
+// merge returns the instance's settings for the given keys, overridden by the
+// given explicit settings.
+func (i *instance) merge(explicit settings, keys []string) settings {
+	merged := make(settings)
+
+	for _, key := range keys {
+		if values, found := i.values[key]; found {
+			merged[key] = values
+		}
+	}
+
+	for key, values := range explicit {
+		merged[key] = values
+	}
+
+	return merged
+}
+
+// mergePositions returns the positions of the commands of the settings merge
+// returns for the given explicit settings, which are at the given positions:
+// those of the instance for the keys the explicit settings don't override,
+// then the explicit ones.
+func (i *instance) mergePositions(explicit settings, positions []position) []position {
+	var merged []position
+	for _, p := range i.positions {
+		if _, overridden := explicit[p.key]; !overridden {
+			merged = append(merged, p)
+		}
+	}
+	return append(merged, positions...)
+}
+
+// splitArgs splits a comma-separated list of template arguments. Commas
+// within double quotes don't count.
+func splitArgs(args string) []string {
+	var split []string
+	var current strings.Builder
+	quoted := false
+
+	for _, r := range args {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ',' && !quoted:
+			split = append(split, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if last := current.String(); strings.TrimSpace(last) != "" || len(split) > 0 {
+		split = append(split, last)
+	}
+
+	return split
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// resolveInclude returns the path of an included file. Relative paths are
+// relative to the including file.
+func resolveInclude(fullpath string, include string) string {
+	include = utils.Expand(include)
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(filepath.Dir(fullpath), include)
+	}
+	return include
+}
+
+// Dependencies returns the paths of the files that the given config file
+// includes, directly or not. They need not exist.
+func Dependencies(fullpath string) []string {
+	var deps []string
+	collectDependencies(fullpath, map[string]bool{fullpath: true}, &deps)
+	return deps
+}
+
+func collectDependencies(fullpath string, visited map[string]bool, deps *[]string) {
+	doc, err := loadDocument(fullpath)
+	if err != nil {
+		return
+	}
+
+	for _, include := range sectionSettings(doc.section(topLevel))["include"] {
+		included := resolveInclude(fullpath, include)
+		if visited[included] {
+			continue
+		}
+
+		visited[included] = true
+		*deps = append(*deps, included)
+		collectDependencies(included, visited, deps)
+	}
+}
@@ -0,0 +1,69 @@
+package action
+
+import (
+	"testing"
+)
+
+func Test_fillParams(t *testing.T) {
+	args := map[string]string{
+		"plain": "de",
+		"evil":  `x"; rm -rf / #'$(id)`,
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		want  string
+	}{
+		{
+			name:  "match key",
+			key:   "attr",
+			value: "serial=${evil}",
+			want:  `serial=x"; rm -rf / #'$(id)`,
+		},
+		{
+			name:  "unquoted command",
+			key:   "exec",
+			value: "setxkbmap ${plain} ${evil}",
+			want:  `setxkbmap 'de' 'x"; rm -rf / #'\''$(id)'`,
+		},
+		{
+			name:  "single-quoted command",
+			key:   "exec",
+			value: "echo '${evil}'",
+			want:  `echo 'x"; rm -rf / #'\''$(id)'`,
+		},
+		{
+			name:  "double-quoted command",
+			key:   "run_while_present",
+			value: `echo "it's ${evil}" ${plain}`,
+			want:  `echo "it's x\"; rm -rf / #'\$(id)" 'de'`,
+		},
+		{
+			name:  "other placeholders",
+			key:   "script",
+			value: "echo ${HOME} ${plain}",
+			want:  "echo ${HOME} 'de'",
+		},
+		{
+			name:  "argv string",
+			key:   "argv",
+			value: `["echo", "\"${evil}\"", "${plain}"]`,
+			want:  `["echo", "\"x\"; rm -rf / #'$(id)\"", "de"]`,
+		},
+		{
+			name:  "argv element",
+			key:   "argv",
+			value: `["echo", ${evil}]`,
+			want:  `["echo", "x\"; rm -rf / #'$(id)"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fillParams(tt.key, tt.value, args); got != tt.want {
+				t.Errorf("fillParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package action
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Criterion is the outcome of checking one of an action's match criteria
+// against a device event.
+type Criterion struct {
+	// Key names the criterion, for instance "subsystem" or "attr idVendor".
+	Key string
+	// Actual is the device's value for the criterion.
+	Actual string
+	// Missing is set if the device doesn't have the attribute or uevent
+	// property the criterion is about.
+	Missing bool
+	// Expected lists the values the criterion accepts.
+	Expected []string
+	// Matched is set if the device's value is one of the expected ones.
+	Matched bool
+}
+
+func (c Criterion) String() string {
+	// Unquoted, so that it can't be mistaken for a value.
+	actual := fmt.Sprintf("%q", c.Actual)
+	if c.Missing {
+		actual = "<missing>"
+	}
+
+	result := "ok"
+	if !c.Matched {
+		result = "FAILED"
+	}
+
+	return fmt.Sprintf("%s: %s, expected one of %q: %s",
+		c.Key, actual, c.Expected, result)
+}
+
+// MatchTrace records how each of an action's match criteria fared against a
+// device event. Criteria that the action doesn't specify are left out.
+type MatchTrace struct {
+	Action   string
+	Criteria []Criterion
+}
+
+// Matched reports whether all the criteria matched.
+func (t MatchTrace) Matched() bool {
+	return len(t.Failures()) == 0
+}
+
+// Failures returns the criteria that did not match.
+func (t MatchTrace) Failures() []Criterion {
+	var failures []Criterion
+	for _, c := range t.Criteria {
+		if !c.Matched {
+			failures = append(failures, c)
+		}
+	}
+	return failures
+}
+
+// NearMiss reports whether all the criteria but one matched.
+func (t MatchTrace) NearMiss() bool {
+	return len(t.Criteria) > 1 && len(t.Failures()) == 1
+}
+
+func (t MatchTrace) String() string {
+	result := "match"
+	if !t.Matched() {
+		result = "no match"
+	}
+
+	str := fmt.Sprintf("%s: %s", t.Action, result)
+	for _, c := range t.Criteria {
+		str += "\n  " + c.String()
+	}
+
+	return str
+}
+
+// check evaluates a criterion and records it in the trace, unless the action
+// doesn't specify any expected value for it.
+func (t *MatchTrace) check(key string, actual string, missing bool, expected []string) {
+	if len(expected) == 0 {
+		return
+	}
+
+	t.Criteria = append(t.Criteria, Criterion{
+		Key:      key,
+		Actual:   actual,
+		Missing:  missing,
+		Expected: expected,
+		Matched:  !missing && foundIn(actual, expected),
+	})
+}
+
+// sortedKeys returns the keys of the given criteria map, sorted, so that traces
+// are stable.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,113 @@
+package action
+
+import (
+	"testing"
+
+	"onplugd/device"
+	"onplugd/deviceevent"
+)
+
+func Test_Explain(t *testing.T) {
+	fullpath := writeConf(t, `[match]
+subsystem = usb
+attr = idVendor=046d
+attr = idVendor=1d6b
+uevent = DEVTYPE=usb_device
+
+[action]
+exec = true
+`)
+	actions, err := NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		subsystem    string
+		attrs        map[string]string
+		uevent       map[string]string
+		wantMatched  bool
+		wantNearMiss bool
+		want         string
+	}{
+		{
+			name:        "match",
+			subsystem:   "usb",
+			attrs:       map[string]string{"idVendor": "1d6b"},
+			uevent:      map[string]string{"DEVTYPE": "usb_device"},
+			wantMatched: true,
+			want: `test.conf: match
+  event: "ADD", expected one of ["COLDPLUG" "ADD"]: ok
+  subsystem: "usb", expected one of ["usb"]: ok
+  attr idVendor: "1d6b", expected one of ["046d" "1d6b"]: ok
+  uevent DEVTYPE: "usb_device", expected one of ["usb_device"]: ok`,
+		},
+		{
+			name:         "near miss",
+			subsystem:    "usb",
+			attrs:        map[string]string{"idVendor": "8086"},
+			uevent:       map[string]string{"DEVTYPE": "usb_device"},
+			wantNearMiss: true,
+			want: `test.conf: no match
+  event: "ADD", expected one of ["COLDPLUG" "ADD"]: ok
+  subsystem: "usb", expected one of ["usb"]: ok
+  attr idVendor: "8086", expected one of ["046d" "1d6b"]: FAILED
+  uevent DEVTYPE: "usb_device", expected one of ["usb_device"]: ok`,
+		},
+		{
+			name:      "missing attribute and property",
+			subsystem: "usb",
+			want: `test.conf: no match
+  event: "ADD", expected one of ["COLDPLUG" "ADD"]: ok
+  subsystem: "usb", expected one of ["usb"]: ok
+  attr idVendor: <missing>, expected one of ["046d" "1d6b"]: FAILED
+  uevent DEVTYPE: <missing>, expected one of ["usb_device"]: FAILED`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := device.New("/devices/usb1")
+			d.SetSubsystem(tt.subsystem)
+			for k, v := range tt.attrs {
+				d.Attrs()[k] = v
+			}
+			for k, v := range tt.uevent {
+				d.Uevent()[k] = v
+			}
+
+			trace := actions[0].Explain(deviceevent.New(deviceevent.Add, d))
+			if got := trace.Matched(); got != tt.wantMatched {
+				t.Errorf("Matched() = %v, want %v", got, tt.wantMatched)
+			}
+			if got := trace.NearMiss(); got != tt.wantNearMiss {
+				t.Errorf("NearMiss() = %v, want %v", got, tt.wantNearMiss)
+			}
+			if got := trace.String(); got != tt.want {
+				t.Errorf("String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_MatchTraceNearMiss(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria []Criterion
+		want     bool
+	}{
+		{name: "no criteria", want: false},
+		{name: "single failure", criteria: []Criterion{{Matched: false}}, want: false},
+		{name: "one of two", criteria: []Criterion{{Matched: true}, {Matched: false}}, want: true},
+		{name: "two of three", criteria: []Criterion{{Matched: false}, {Matched: true}, {Matched: false}}, want: false},
+		{name: "all", criteria: []Criterion{{Matched: true}, {Matched: true}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace := MatchTrace{Action: "test", Criteria: tt.criteria}
+			if got := trace.NearMiss(); got != tt.want {
+				t.Errorf("NearMiss() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
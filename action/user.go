@@ -0,0 +1,221 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"onplugd/executor"
+)
+
+// credential returns who the commands of the action run as, given by the
+// user, group and groups keys, or nil if they run as the daemon's user. The
+// group defaults to the primary group of the user, and the supplementary groups
+// to those the user belongs to.
+//
+// The commands of a config that root doesn't own, or that uses a template from
+// a file that root doesn't own or that is included through one, may only run as
+// the owner of those files, with
+// groups the owner belongs to, so that a user who can write configs doesn't get
+// to act as another. Without a user key, they run as the owner.
+func (l *linter) credential(section string, s settings, files []string) *executor.Credential {
+
+	owner, ok := l.owner(files)
+	if !ok {
+		return nil
+	}
+
+	userName, groupName, groupNames := last(s["user"]), last(s["group"]), s["groups"]
+	if userName == "" && groupName == "" && len(groupNames) == 0 {
+		if owner == nil || owner.Uid == strconv.Itoa(os.Geteuid()) {
+			return nil
+		}
+		userName = owner.Uid
+	}
+
+	u, err := lookupUser(userName)
+	if err != nil {
+		l.report(Error, l.keyLine(section, "user", userName), "%s", err)
+		return nil
+	}
+
+	c := executor.Credential{User: u.Username, Home: u.HomeDir}
+	c.Uid, _ = parseID(u.Uid)
+	c.Gid, _ = parseID(u.Gid)
+
+	if groupName != "" {
+		if c.Gid, err = lookupGroup(groupName); err != nil {
+			l.report(Error, l.keyLine(section, "group", groupName), "%s", err)
+			return nil
+		}
+	}
+
+	if len(groupNames) > 0 {
+		for _, value := range groupNames {
+			for _, name := range strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			}) {
+				gid, err := lookupGroup(name)
+				if err != nil {
+					l.report(Error, l.keyLine(section, "groups", value), "%s", err)
+					return nil
+				}
+				c.Groups = append(c.Groups, gid)
+			}
+		}
+	} else if userName != "" {
+		if c.Groups, err = userGroups(u); err != nil {
+			l.report(Error, l.keyLine(section, "user", userName),
+				"cannot list the groups of %s: %s", u.Username, err)
+			return nil
+		}
+	}
+
+	if owner != nil && !l.checkOwner(section, &c, owner) {
+		return nil
+	}
+
+	return &c
+}
+
+// owner returns the user other than root who owns some of the given files, or
+// nil if root owns them all. Files owned by different users other than root
+// are reported, as well as the files that can't be checked.
+func (l *linter) owner(files []string) (*user.User, bool) {
+
+	var owner *user.User
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			l.report(Error, 0, "%s", err)
+			return nil, false
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid == 0 {
+			continue
+		}
+
+		uid := strconv.FormatUint(uint64(stat.Uid), 10)
+		if owner != nil && owner.Uid != uid {
+			l.report(Error, 0, "%s is owned by another user than %s, and neither is root",
+				file, files[0])
+			return nil, false
+		}
+
+		u, err := user.LookupId(uid)
+		if err != nil {
+			l.report(Error, 0, "%s", err)
+			return nil, false
+		}
+		owner = u
+	}
+
+	return owner, true
+}
+
+// checkOwner reports whether a config file owned by the given user, other than
+// root, may run commands with the given credential.
+func (l *linter) checkOwner(section string, c *executor.Credential, owner *user.User) bool {
+
+	if uid, _ := parseID(owner.Uid); c.Uid != uid {
+		l.report(Error, l.keyLine(section, "user", ""),
+			"cannot run commands as %s: the config file is not owned by root", c.User)
+		return false
+	}
+
+	allowed, err := userGroups(owner)
+	if err != nil {
+		l.report(Error, 0, "cannot list the groups of %s: %s", owner.Username, err)
+		return false
+	}
+	primary, _ := parseID(owner.Gid)
+	allowed = append(allowed, primary)
+
+	for _, gid := range append([]uint32{c.Gid}, c.Groups...) {
+		if !containsID(allowed, gid) {
+			key := "groups"
+			if gid == c.Gid {
+				key = "group"
+			}
+			l.report(Error, l.keyLine(section, key, ""),
+				"cannot run commands with group %d: the config file is not owned by root, and %s is not a member",
+				gid, owner.Username)
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupUser finds a user by name or numeric ID, or returns the current user
+// if the name is empty.
+func lookupUser(name string) (*user.User, error) {
+	if name == "" {
+		return user.Current()
+	}
+
+	u, err := user.Lookup(name)
+	if _, isNumeric := parseID(name); err != nil && isNumeric == nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user '%s'", name)
+	}
+	return u, nil
+}
+
+// lookupGroup finds the ID of a group given by name or numeric ID.
+func lookupGroup(name string) (uint32, error) {
+	g, err := user.LookupGroup(name)
+	if _, isNumeric := parseID(name); err != nil && isNumeric == nil {
+		g, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unknown group '%s'", name)
+	}
+	return parseID(g.Gid)
+}
+
+func userGroups(u *user.User) ([]uint32, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var gids []uint32
+	for _, id := range ids {
+		gid, err := parseID(id)
+		if err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// last returns the last of the given values, which is the one in effect for
+// keys that take a single value, or "" if there is none.
+func last(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
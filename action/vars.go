@@ -0,0 +1,157 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"gopkg.in/ini.v1"
+
+	"onplugd/utils"
+)
+
+// VarsFile is the name of the config file that holds the variables shared by
+// all the configs.
+const VarsFile = "vars.conf"
+
+// runtimePrefix is the prefix of the variables that get set when commands
+// run, and that are therefore left alone at load time.
+const runtimePrefix = "ONPLUGD_"
+
+// Vars are the variables that can be referenced as ${NAME} in config values.
+// Values other than shell commands may also reference the environment, while
+// shell commands leave the references to anything but Vars to the shell. Either
+// way, $${NAME} stands for a literal ${NAME}.
+type Vars map[string]string
+
+// variableRegexp matches ${NAME} references, as well as $${NAME} escapes for a
+// literal ${NAME}.
+var variableRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadVars loads the variables defined at the top level of the given file, in
+// the form NAME = value. Values may reference the environment and the
+// variables defined before them, and may start with ~ or ~user/. An empty path
+// yields no variables.
+//
+// The variables end up in the commands of every config, including those root
+// owns, so the file must be owned by root or by the user the daemon runs as.
+func LoadVars(fullpath string) (Vars, error) {
+
+	vars := make(Vars)
+	if fullpath == "" {
+		return vars, nil
+	}
+
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 && int(stat.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("%s: not owned by root, yet its variables get expanded into the commands of configs that are",
+			fullpath)
+	}
+
+	conf, err := ini.Load(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, section := range conf.Sections() {
+		if section.Name() != ini.DefaultSection {
+			return nil, fmt.Errorf("%s: unexpected section [%s], variables go at the top level",
+				fullpath, section.Name())
+		}
+
+		for _, key := range section.Keys() {
+			value, err := vars.Expand(key.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", fullpath, key.Name(), err)
+			}
+			vars[key.Name()] = utils.Expand(value)
+		}
+	}
+
+	return vars, nil
+}
+
+// Expand replaces the ${NAME} references in the given value with the value of
+// the variable, or failing that of the environment variable, of that name.
+// References to ONPLUGD_* variables are left for the shell to expand at run
+// time, and $${NAME} stands for a literal ${NAME}.
+func (v Vars) Expand(value string) (string, error) {
+	return v.expand(value, true)
+}
+
+// expandCommand is Expand for shell commands, where ${NAME} may just as well
+// be a shell variable: only the variables of vars.conf get expanded, and the
+// other references are left for the shell.
+func (v Vars) expandCommand(value string) (string, error) {
+	return v.expand(value, false)
+}
+
+func (v Vars) expand(value string, strict bool) (string, error) {
+
+	var unknown []string
+
+	expanded := variableRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+
+		name := ref[2 : len(ref)-1]
+		if strings.HasPrefix(name, runtimePrefix) {
+			return ref
+		}
+
+		if value, found := v[name]; found {
+			return value
+		}
+		if !strict {
+			return ref
+		}
+		if value, found := os.LookupEnv(name); found {
+			return value
+		}
+
+		unknown = append(unknown, name)
+		return ref
+	})
+
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown variable '%s'", strings.Join(unknown, "', '"))
+	}
+
+	return expanded, nil
+}
+
+// commandKeys are the keys that hold shell commands.
+var commandKeys = map[string]bool{"exec": true, "script": true, "run_while_present": true}
+
+// expandSettings expands the variables in all the given settings of the given
+// section, reporting unknown ones, as well as a leading ~ or ~user/ in the
+// values other than commands.
+func (l *linter) expandSettings(section string, s settings, vars Vars) {
+	for key, values := range s {
+		for i, value := range values {
+			expand := vars.Expand
+			switch {
+			case key == "argv":
+				expand = vars.expandArgv
+			case commandKeys[key]:
+				expand = vars.expandCommand
+			}
+
+			expanded, err := expand(value)
+			if err != nil {
+				l.report(Error, l.keyLine(section, key, value), "%s", err)
+				continue
+			}
+			if !commandKeys[key] && key != "argv" {
+				expanded = utils.Expand(expanded)
+			}
+			values[i] = expanded
+		}
+	}
+}
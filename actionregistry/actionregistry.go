@@ -1,8 +1,11 @@
 package actionregistry
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"onplugd/action"
 	"onplugd/deviceevent"
@@ -16,43 +19,214 @@ type ActionRegistry struct {
 	executor executor.IExecutor
 	lock     sync.RWMutex
 	pipe     messagepipe.IMessagePipe
+
+	// The contexts of the commands run for each device, by devpath, which
+	// get cancelled when the device goes away.
+	devices     map[string]deviceContext
+	devicesLock sync.Mutex
+
+	scheduler *scheduler
+	presence  *presence
+
+	// Closed to drop the pending delayed runs, then replaced.
+	stopped chan struct{}
+	// How many delayed runs are pending.
+	delayed     int
+	delayedLock sync.Mutex
+	// Starts the timer of a delayed run, returning its channel and the
+	// function that stops it.
+	timer func(time.Duration) (<-chan time.Time, func() bool)
 }
 
 // New creates and returns an ActionRegistry instance.
 func New(
 	pipe messagepipe.IMessagePipe, executor executor.IExecutor) *ActionRegistry {
 	ar := ActionRegistry{
-		actions:  make(map[string]action.IAction),
-		executor: executor,
-		pipe:     pipe,
+		actions:   make(map[string]action.IAction),
+		executor:  executor,
+		pipe:      pipe,
+		devices:   make(map[string]deviceContext),
+		scheduler: newScheduler(pipe),
+		presence:  newPresence(pipe, executor),
+		stopped:   make(chan struct{}),
+		timer: func(d time.Duration) (<-chan time.Time, func() bool) {
+			t := time.NewTimer(d)
+			return t.C, t.Stop
+		},
 	}
 
 	return &ar
 }
 
-// OnDeviceEvent calls all the matching actions when a new device event
-// arrives.
+// OnDeviceEvent calls the matching actions when a new device event arrives,
+// by increasing priority value then by name. An action marked as final stops
+// the actions after it from handling the event. When each run actually starts
+// depends on the concurrency policy and lock of its action.
 func (ar *ActionRegistry) OnDeviceEvent(event deviceevent.IDeviceEvent) {
 	ar.lock.RLock()
 
+	var names []string
+	for name := range ar.actions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := ar.actions[names[i]].Priority(), ar.actions[names[j]].Priority()
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+
 	var actions []action.IAction
-	for name, action := range ar.actions {
-		if action.Match(event) {
+	var matched []string
+	for i, name := range names {
+		action := ar.actions[name]
+		trace := action.Explain(event)
+		if trace.Matched() {
 			actions = append(actions, action)
+			matched = append(matched, name)
 			ar.pipe.Debug(fmt.Sprint("Match found: ", name))
+
+			if action.Final() {
+				skipped := 0
+				for _, other := range names[i+1:] {
+					if ar.actions[other].Match(event) {
+						skipped++
+					}
+				}
+				if skipped > 0 {
+					ar.pipe.Debug(fmt.Sprintf(
+						"%s is final, skipping %d other matching action(s)", name, skipped))
+				}
+				break
+			}
+		} else if trace.NearMiss() {
+			ar.pipe.Debug(fmt.Sprint("Near miss: ", trace))
 		}
 	}
 
 	ar.lock.RUnlock()
 
-	for _, a := range actions {
-		go func(action action.IAction) {
-			err := action.Do(event, ar.executor)
-			if err != nil {
-				ar.pipe.Error(err)
-			}
-		}(a)
+	ctx := ar.deviceContext(event)
+
+	if event.Event() == deviceevent.Remove {
+		ar.presence.stopDevice(event.Device().Path())
+	}
+	for i, a := range actions {
+		if a.RunsWhilePresent() && event.Event() != deviceevent.Remove {
+			ar.presence.start(matched[i], a, event)
+		}
+	}
+
+	// Scheduled right away rather than in the goroutines, so that the runs
+	// that wait for the previous ones do so in the order of the events.
+	for i, a := range actions {
+		if a.Delay() > 0 {
+			ar.delay(ctx, matched[i], a, event)
+			continue
+		}
+		if r := ar.scheduler.schedule(ctx, matched[i], a, event); r != nil {
+			go ar.start(r)
+		}
+	}
+}
+
+// delay runs the given action for the given event once its delay is over,
+// unless the device goes away or the registry stops in the meantime.
+func (ar *ActionRegistry) delay(
+	ctx context.Context, name string, a action.IAction, event deviceevent.IDeviceEvent) {
+
+	ar.delayedLock.Lock()
+	stopped := ar.stopped
+	ar.delayed++
+	ar.pipe.Debug(fmt.Sprintf("Running %s for %s in %s, %d delayed run(s) pending",
+		name, event.Device().Path(), a.Delay(), ar.delayed))
+	ar.delayedLock.Unlock()
+
+	expired, stop := ar.timer(a.Delay())
+	go func() {
+		defer stop()
+
+		var reason string
+		select {
+		case <-expired:
+		case <-ctx.Done():
+			reason = "the device went away"
+		case <-stopped:
+			reason = "stopping"
+		}
+
+		ar.delayedLock.Lock()
+		ar.delayed--
+		select {
+		case <-stopped:
+			reason = "stopping"
+		default:
+		}
+		ar.delayedLock.Unlock()
+
+		if reason != "" {
+			ar.pipe.Debug(fmt.Sprintf("Delayed run of %s for %s cancelled, %s",
+				name, event.Device().Path(), reason))
+			return
+		}
+
+		if r := ar.scheduler.schedule(ctx, name, a, event); r != nil {
+			ar.start(r)
+		}
+	}()
+}
+
+func (ar *ActionRegistry) start(r *run) {
+	if err := ar.scheduler.start(r, ar.executor); err != nil {
+		ar.pipe.Error(err)
+	}
+}
+
+// deviceContext returns the context of the commands run for the given event.
+// The removal of a device cancels the pending retries of the commands run for
+// it so far, as well as their runs that didn't start yet, and its own commands
+// get a context of their own.
+func (ar *ActionRegistry) deviceContext(event deviceevent.IDeviceEvent) context.Context {
+	ar.devicesLock.Lock()
+	defer ar.devicesLock.Unlock()
+
+	devpath := event.Device().Path()
+
+	if event.Event() == deviceevent.Remove {
+		if d, found := ar.devices[devpath]; found {
+			d.cancel()
+			delete(ar.devices, devpath)
+		}
+		return context.Background()
+	}
+
+	d, found := ar.devices[devpath]
+	if !found {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+		ar.devices[devpath] = d
+	}
+	return d.ctx
+}
+
+type deviceContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Stop drops the pending delayed runs, and stops the processes run while
+// devices are present.
+func (ar *ActionRegistry) Stop() {
+	ar.presence.stopAll()
+
+	ar.delayedLock.Lock()
+	defer ar.delayedLock.Unlock()
+
+	if ar.delayed > 0 {
+		ar.pipe.Debug(fmt.Sprintf("Dropping %d delayed run(s)", ar.delayed))
 	}
+	close(ar.stopped)
+	ar.stopped = make(chan struct{})
 }
 
 // Update updates an IAction in the registry, by name.
@@ -60,6 +234,12 @@ func (ar *ActionRegistry) Update(name string, action action.IAction) {
 	ar.lock.Lock()
 	defer ar.lock.Unlock()
 	ar.actions[name] = action
+
+	// The processes keep running with the command they started with, unless
+	// the action no longer has one.
+	if !action.RunsWhilePresent() {
+		ar.presence.stopAction(name)
+	}
 }
 
 // Remove removes an IAction from the registry, by name.
@@ -67,4 +247,5 @@ func (ar *ActionRegistry) Remove(name string) {
 	ar.lock.Lock()
 	defer ar.lock.Unlock()
 	delete(ar.actions, name)
+	ar.presence.stopAction(name)
 }
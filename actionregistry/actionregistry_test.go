@@ -0,0 +1,182 @@
+package actionregistry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"onplugd/action"
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/messagepipe"
+)
+
+func Test_OnDeviceEventDelay(t *testing.T) {
+	pipe := messagepipe.New(false)
+	ar := New(&pipe, nil)
+
+	log := &runLog{}
+	releases := make(map[string]chan struct{})
+	for _, path := range []string{"/devices/1", "/devices/2", "/devices/3"} {
+		releases[path] = make(chan struct{})
+		close(releases[path])
+	}
+	ar.Update("delayed", &fakeAction{delay: time.Minute, log: log, releases: releases})
+
+	// The delays are over when the test says so, in the order of the events.
+	var timers []chan time.Time
+	ar.timer = func(d time.Duration) (<-chan time.Time, func() bool) {
+		if d != time.Minute {
+			t.Errorf("timer for %s, want 1m0s", d)
+		}
+		timers = append(timers, make(chan time.Time, 1))
+		return timers[len(timers)-1], func() bool { return true }
+	}
+
+	// Goes away before the delay is over.
+	ar.OnDeviceEvent(deviceevent.New(deviceevent.Add, device.New("/devices/2")))
+	ar.OnDeviceEvent(deviceevent.New(deviceevent.Remove, device.New("/devices/2")))
+	// Shows up just before stopping.
+	ar.OnDeviceEvent(deviceevent.New(deviceevent.Add, device.New("/devices/3")))
+	ar.Stop()
+	// Stays long enough, and would come after the others if they ran.
+	ar.OnDeviceEvent(deviceevent.New(deviceevent.Add, device.New("/devices/1")))
+
+	if len(timers) != 3 {
+		t.Fatalf("%d timer(s) started, want 3", len(timers))
+	}
+	timers[2] <- time.Now()
+
+	log.wait(t, "end /devices/1")
+
+	want := []string{"start /devices/1", "end /devices/1"}
+	if got := log.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("runs = %v, want %v", got, want)
+	}
+}
+
+func Test_OnDeviceEventWhilePresent(t *testing.T) {
+	pipe := messagepipe.New(false)
+	ar := New(&pipe, nil)
+
+	log := &runLog{}
+	releases := make(map[string]chan struct{})
+	for _, label := range []string{"/devices/1", "/devices/2 COLDPLUG"} {
+		releases[label] = make(chan struct{})
+		close(releases[label])
+	}
+	ar.Update("present", &fakeAction{present: true, log: log, releases: releases})
+
+	steps := []struct {
+		step func()
+		want string
+	}{
+		{
+			step: func() { ar.OnDeviceEvent(deviceevent.New(deviceevent.Add, device.New("/devices/1"))) },
+			want: "present /devices/1",
+		},
+		{
+			step: func() { ar.OnDeviceEvent(deviceevent.New(deviceevent.Remove, device.New("/devices/1"))) },
+			want: "gone /devices/1",
+		},
+		{
+			// Present at startup.
+			step: func() { ar.OnDeviceEvent(deviceevent.New(deviceevent.Coldplug, device.New("/devices/2"))) },
+			want: "present /devices/2",
+		},
+		{
+			// Keeps the process it already has.
+			step: func() { ar.OnDeviceEvent(deviceevent.New(deviceevent.Coldplug, device.New("/devices/2"))) },
+		},
+		{
+			step: func() { ar.Remove("present") },
+			want: "gone /devices/2",
+		},
+	}
+	for _, s := range steps {
+		s.step()
+		if s.want != "" {
+			log.wait(t, s.want)
+		}
+	}
+
+	// The runs of the action itself do nothing, but happen anyway.
+	var got []string
+	for _, entry := range log.get() {
+		if !strings.HasPrefix(entry, "start ") && !strings.HasPrefix(entry, "end ") {
+			got = append(got, entry)
+		}
+	}
+
+	want := []string{"present /devices/1", "gone /devices/1", "present /devices/2", "gone /devices/2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runs = %v, want %v", got, want)
+	}
+}
+
+// tracedAction is a fakeAction that explains its matches with a given trace.
+type tracedAction struct {
+	*fakeAction
+	trace action.MatchTrace
+}
+
+func (a *tracedAction) Explain(deviceevent.IDeviceEvent) action.MatchTrace { return a.trace }
+
+func Test_OnDeviceEventNearMiss(t *testing.T) {
+	ok := action.Criterion{Key: "subsystem", Actual: "usb", Expected: []string{"usb"}, Matched: true}
+	failed := action.Criterion{Key: "attr idVendor", Actual: "8086", Expected: []string{"046d"}}
+
+	tests := []struct {
+		name     string
+		criteria []action.Criterion
+		want     []string
+	}{
+		{
+			name:     "near miss",
+			criteria: []action.Criterion{ok, failed},
+			want: []string{"Near miss: near: no match\n" +
+				"  subsystem: \"usb\", expected one of [\"usb\"]: ok\n" +
+				"  attr idVendor: \"8086\", expected one of [\"046d\"]: FAILED"},
+		},
+		{
+			name:     "miss",
+			criteria: []action.Criterion{failed, failed},
+		},
+		{
+			name:     "single criterion",
+			criteria: []action.Criterion{failed},
+		},
+		{
+			name:     "match",
+			criteria: []action.Criterion{ok, ok},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipe := messagepipe.New(false)
+			var got []string
+			pipe.AddHandler(func(severity messagepipe.Severity, message string) {
+				// Runs log from other goroutines, near misses don't.
+				if severity == messagepipe.SeverityDebug && strings.HasPrefix(message, "Near miss: ") {
+					got = append(got, message)
+				}
+			})
+			ar := New(&pipe, nil)
+			defer ar.Stop()
+
+			releases := map[string]chan struct{}{"/devices/1": make(chan struct{})}
+			close(releases["/devices/1"])
+			ar.Update("near", &tracedAction{
+				fakeAction: &fakeAction{log: &runLog{}, releases: releases},
+				trace:      action.MatchTrace{Action: "near", Criteria: tt.criteria},
+			})
+
+			ar.OnDeviceEvent(deviceevent.New(deviceevent.Add, device.New("/devices/1")))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("near misses = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
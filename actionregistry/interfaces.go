@@ -11,4 +11,5 @@ type IActionRegistry interface {
 	OnDeviceEvent(event deviceevent.IDeviceEvent)
 	Update(name string, action action.IAction)
 	Remove(name string)
+	Stop()
 }
@@ -0,0 +1,123 @@
+package actionregistry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"onplugd/action"
+	"onplugd/deviceevent"
+	"onplugd/executor"
+	"onplugd/messagepipe"
+)
+
+// presence keeps the run_while_present processes of the actions going for as
+// long as the devices they run for are present.
+type presence struct {
+	pipe     messagepipe.IMessagePipe
+	executor executor.IExecutor
+	lock     sync.Mutex
+	// The processes by action name, then by devpath.
+	processes map[string]map[string]*process
+}
+
+// process is a run_while_present process, owned by the instance of the device
+// whose event started it: a process started for a previous instance of a
+// device with the same devpath is not mistaken for it.
+type process struct {
+	event  deviceevent.IDeviceEvent
+	cancel context.CancelFunc
+}
+
+func newPresence(pipe messagepipe.IMessagePipe, executor executor.IExecutor) *presence {
+	return &presence{
+		pipe:      pipe,
+		executor:  executor,
+		processes: make(map[string]map[string]*process),
+	}
+}
+
+// start starts the process of the given action for the device of the given
+// event, such as the COLDPLUG of a device present at startup, unless it already
+// runs for it. An ADD event stands for a new instance of the device, and
+// replaces the process run for the previous one.
+func (p *presence) start(name string, a action.IAction, event deviceevent.IDeviceEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	devpath := event.Device().Path()
+	if p.processes[name] == nil {
+		p.processes[name] = make(map[string]*process)
+	}
+	if previous := p.processes[name][devpath]; previous != nil {
+		if event.Event() != deviceevent.Add {
+			return
+		}
+		p.pipe.Info(fmt.Sprintf("Stopping %s for the previous instance of %s", name, devpath))
+		previous.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := &process{event: event, cancel: cancel}
+	p.processes[name][devpath] = proc
+	p.pipe.Debug(fmt.Sprintf("Running %s while %s is present", name, devpath))
+
+	go func() {
+		if err := a.RunWhilePresent(ctx, event, p.executor); err != nil {
+			p.pipe.Error(err)
+		}
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		cancel()
+		if p.processes[name][devpath] == proc {
+			p.remove(name, devpath)
+		}
+	}()
+}
+
+// stopDevice stops the processes run for the given device, which went away.
+func (p *presence) stopDevice(devpath string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for name := range p.processes {
+		if p.processes[name][devpath] != nil {
+			p.pipe.Info(fmt.Sprintf("Stopping %s, %s went away", name, devpath))
+			p.processes[name][devpath].cancel()
+			p.remove(name, devpath)
+		}
+	}
+}
+
+// stopAction stops the processes of the given action, which is gone.
+func (p *presence) stopAction(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for devpath, proc := range p.processes[name] {
+		p.pipe.Info(fmt.Sprintf("Stopping %s for %s, the action is gone", name, devpath))
+		proc.cancel()
+	}
+	delete(p.processes, name)
+}
+
+// stopAll stops all the processes.
+func (p *presence) stopAll() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, processes := range p.processes {
+		for _, proc := range processes {
+			proc.cancel()
+		}
+	}
+	p.processes = make(map[string]map[string]*process)
+}
+
+func (p *presence) remove(name string, devpath string) {
+	delete(p.processes[name], devpath)
+	if len(p.processes[name]) == 0 {
+		delete(p.processes, name)
+	}
+}
@@ -0,0 +1,270 @@
+package actionregistry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"onplugd/action"
+	"onplugd/deviceevent"
+	"onplugd/executor"
+	"onplugd/messagepipe"
+)
+
+// scheduler decides when the runs of the actions start, following their
+// concurrency policy and the locks they hold.
+//
+// Runs are scheduled in the order of the events, and only ever wait for runs
+// scheduled before them, which start in turn: this is what keeps them from
+// waiting for each other forever.
+type scheduler struct {
+	pipe messagepipe.IMessagePipe
+	lock sync.Mutex
+	// What runs of each action are going on, by action name, or by action
+	// name and devpath for the device policy.
+	actions map[string]*runQueue
+	// What runs hold each lock, by lock name.
+	locks map[string]*runQueue
+	// The recent runs of the actions with a cooldown or a rate limit, by
+	// action name.
+	throttles map[string]*throttle
+	// The clock the throttles go by.
+	now func() time.Time
+}
+
+// runQueue is the runs of an action, or holding a lock, that were scheduled
+// and are not done yet.
+type runQueue struct {
+	// Where the queue is, to forget about it once there is nothing going on.
+	queues map[string]*runQueue
+	key    string
+
+	active int
+	// The last run, which the next one may wait for or replace.
+	last *run
+}
+
+// throttle tracks the recent runs of an action, for its cooldown and rate
+// limit, as well as the triggers they suppressed.
+type throttle struct {
+	// When the action last ran for each device.
+	lastRuns map[string]time.Time
+	// When it ran recently, oldest first.
+	runs []time.Time
+	// How many triggers were suppressed since the last run, for each device
+	// by the cooldown, and overall by the rate limit.
+	cooledDown  map[string]int
+	rateLimited int
+}
+
+// run is a run of an action for an event.
+type run struct {
+	name   string
+	action action.IAction
+	event  deviceevent.IDeviceEvent
+	ctx    context.Context
+	// Done once the run gets replaced, which terminates its commands, or is
+	// over.
+	abort  context.Context
+	cancel context.CancelFunc
+	// The runs to wait for before starting.
+	after []*run
+	// Closed once the run is done, or won't happen.
+	done chan struct{}
+	// The queues the run is part of.
+	queues []*runQueue
+}
+
+func newScheduler(pipe messagepipe.IMessagePipe) *scheduler {
+	return &scheduler{
+		pipe:      pipe,
+		actions:   make(map[string]*runQueue),
+		locks:     make(map[string]*runQueue),
+		throttles: make(map[string]*throttle),
+		now:       time.Now,
+	}
+}
+
+// schedule schedules a run of the given action for the given event, or
+// returns nil if its policy says it shouldn't happen.
+func (s *scheduler) schedule(
+	ctx context.Context, name string, a action.IAction,
+	event deviceevent.IDeviceEvent) *run {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	suppressed, allowed := s.throttle(name, a, event)
+	if !allowed {
+		return nil
+	}
+	if suppressed > 0 {
+		s.pipe.Info(fmt.Sprintf("%s runs after %d suppressed trigger(s)", name, suppressed))
+		ctx = action.WithSuppressed(ctx, suppressed)
+	}
+
+	key := name
+	if a.Concurrency() == action.ConcurrencyDevice {
+		key = name + "\x00" + event.Device().Path()
+	}
+	q := s.queue(s.actions, key)
+
+	r := &run{name: name, action: a, event: event, done: make(chan struct{})}
+	r.abort, r.cancel = context.WithCancel(context.Background())
+	r.ctx = action.WithAbort(ctx, r.abort)
+
+	switch a.Concurrency() {
+	case action.ConcurrencyQueue, action.ConcurrencyDevice:
+		if q.last != nil {
+			s.pipe.Debug(fmt.Sprintf("%s queued behind %d run(s) of it", name, q.active))
+			r.after = append(r.after, q.last)
+		}
+
+	case action.ConcurrencyReplace:
+		if q.last != nil {
+			s.pipe.Info(fmt.Sprintf("Replacing the run(s) of %s in progress", name))
+			q.last.cancel()
+			r.after = append(r.after, q.last)
+		}
+
+	case action.ConcurrencySkip:
+		if q.active > 0 {
+			s.pipe.Info(fmt.Sprintf("%s is already running, skipping", name))
+			r.cancel()
+			return nil
+		}
+	}
+	s.join(r, q)
+
+	if lock := a.Lock(); lock != "" {
+		l := s.queue(s.locks, lock)
+		if l.last != nil {
+			s.pipe.Debug(fmt.Sprintf("%s waits for lock %s", name, lock))
+			r.after = append(r.after, l.last)
+		}
+		s.join(r, l)
+	}
+
+	return r
+}
+
+// throttle applies the cooldown and rate limit of the given action to a new
+// trigger for the given event. It reports whether the action may run, and if so
+// how many triggers were suppressed since its last run.
+func (s *scheduler) throttle(
+	name string, a action.IAction, event deviceevent.IDeviceEvent) (int, bool) {
+
+	cooldown := a.Cooldown()
+	limit, period := a.RateLimit()
+	if cooldown == 0 && limit == 0 {
+		delete(s.throttles, name)
+		return 0, true
+	}
+
+	t, found := s.throttles[name]
+	if !found {
+		t = &throttle{lastRuns: make(map[string]time.Time), cooledDown: make(map[string]int)}
+		s.throttles[name] = t
+	}
+
+	now := s.now()
+	devpath := event.Device().Path()
+
+	// Forget about what is over.
+	for path, last := range t.lastRuns {
+		if now.Sub(last) >= cooldown {
+			delete(t.lastRuns, path)
+		}
+	}
+	for len(t.runs) > 0 && (limit == 0 || now.Sub(t.runs[0]) >= period) {
+		t.runs = t.runs[1:]
+	}
+
+	var count int
+	var reason string
+	if _, coolingDown := t.lastRuns[devpath]; coolingDown {
+		t.cooledDown[devpath]++
+		count, reason = t.cooledDown[devpath], fmt.Sprintf("cooldown of %s", cooldown)
+	} else if limit > 0 && len(t.runs) >= limit {
+		t.rateLimited++
+		count, reason = t.rateLimited, fmt.Sprintf("rate limit of %d per %s", limit, period)
+	}
+
+	if reason != "" {
+		msg := fmt.Sprintf("Suppressed %s for %s by its %s (%d trigger(s) so far)",
+			name, devpath, reason, count)
+		if count == 1 {
+			s.pipe.Info(msg)
+		} else {
+			s.pipe.Debug(msg)
+		}
+		return 0, false
+	}
+
+	suppressed := t.cooledDown[devpath] + t.rateLimited
+	delete(t.cooledDown, devpath)
+	t.rateLimited = 0
+
+	if cooldown > 0 {
+		t.lastRuns[devpath] = now
+	}
+	if limit > 0 {
+		t.runs = append(t.runs, now)
+	}
+
+	return suppressed, true
+}
+
+// queue returns the queue with the given key in the given map, creating it if
+// needed.
+func (s *scheduler) queue(queues map[string]*runQueue, key string) *runQueue {
+	q, found := queues[key]
+	if !found {
+		q = &runQueue{queues: queues, key: key}
+		queues[key] = q
+	}
+	return q
+}
+
+func (s *scheduler) join(r *run, q *runQueue) {
+	q.active++
+	q.last = r
+	r.queues = append(r.queues, q)
+}
+
+// finish marks the given run as done.
+func (s *scheduler) finish(r *run) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r.cancel()
+	close(r.done)
+
+	for _, q := range r.queues {
+		q.active--
+		if q.last == r {
+			q.last = nil
+		}
+		if q.active == 0 {
+			delete(q.queues, q.key)
+		}
+	}
+}
+
+// start waits for the runs the given run comes after, then runs it unless it
+// got cancelled in the meantime.
+func (s *scheduler) start(r *run, ex executor.IExecutor) error {
+	defer s.finish(r)
+
+	for _, previous := range r.after {
+		<-previous.done
+	}
+
+	if r.ctx.Err() != nil || r.abort.Err() != nil {
+		s.pipe.Debug(fmt.Sprintf("Run of %s cancelled before it started", r.name))
+		return nil
+	}
+
+	return r.action.Do(r.ctx, r.event, ex)
+}
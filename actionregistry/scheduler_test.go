@@ -0,0 +1,304 @@
+package actionregistry
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"onplugd/action"
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/executor"
+	"onplugd/messagepipe"
+)
+
+// fakeAction records its runs, which last until the run for their device gets
+// released or replaced. Runs for events other than ADD are told apart by their
+// event.
+type fakeAction struct {
+	concurrency string
+	lock        string
+	cooldown    time.Duration
+	rateLimit   int
+	delay       time.Duration
+	present     bool
+
+	log      *runLog
+	releases map[string]chan struct{}
+}
+
+type runLog struct {
+	lock    sync.Mutex
+	entries []string
+	// Closed, and replaced, whenever an entry gets added.
+	added chan struct{}
+}
+
+func (l *runLog) add(entry string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+	if l.added != nil {
+		close(l.added)
+		l.added = nil
+	}
+}
+
+func (l *runLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.entries...)
+}
+
+// wait waits for the given entry to be in the log, failing the test if it
+// doesn't show up.
+func (l *runLog) wait(t *testing.T, entry string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		l.lock.Lock()
+		for _, e := range l.entries {
+			if e == entry {
+				l.lock.Unlock()
+				return
+			}
+		}
+		if l.added == nil {
+			l.added = make(chan struct{})
+		}
+		added := l.added
+		l.lock.Unlock()
+
+		select {
+		case <-added:
+		case <-timeout:
+			t.Fatalf("no %q in %v", entry, l.get())
+		}
+	}
+}
+
+// runLabel identifies the run for the given event in the log.
+func runLabel(event deviceevent.IDeviceEvent) string {
+	label := event.Device().Path()
+	if event.Event() != deviceevent.Add {
+		label += " " + string(event.Event())
+	}
+	return label
+}
+
+func (a *fakeAction) Match(deviceevent.IDeviceEvent) bool { return true }
+
+// Explain matches the ADD and COLDPLUG events.
+func (a *fakeAction) Explain(event deviceevent.IDeviceEvent) action.MatchTrace {
+	return action.MatchTrace{Criteria: []action.Criterion{
+		{Matched: event.Event() == deviceevent.Add || event.Event() == deviceevent.Coldplug},
+	}}
+}
+
+func (a *fakeAction) Do(
+	ctx context.Context, event deviceevent.IDeviceEvent, ex executor.IExecutor) error {
+
+	label := runLabel(event)
+	a.log.add("start " + label)
+	abort := action.Aborted(ctx)
+	select {
+	case <-a.releases[label]:
+	case <-abort.Done():
+	}
+	// Replacing comes first, the test releases runs after that.
+	if abort.Err() != nil {
+		a.log.add("cancel " + label)
+	} else {
+		a.log.add("end " + label)
+	}
+	return nil
+}
+
+func (a *fakeAction) RunsWhilePresent() bool { return a.present }
+
+func (a *fakeAction) RunWhilePresent(
+	ctx context.Context, event deviceevent.IDeviceEvent, ex executor.IExecutor) error {
+
+	path := event.Device().Path()
+	a.log.add("present " + path)
+	<-ctx.Done()
+	a.log.add("gone " + path)
+	return nil
+}
+
+func (a *fakeAction) Priority() int       { return action.DefaultPriority }
+func (a *fakeAction) Final() bool         { return false }
+func (a *fakeAction) Concurrency() string { return a.concurrency }
+func (a *fakeAction) Lock() string        { return a.lock }
+
+func (a *fakeAction) Delay() time.Duration { return a.delay }
+
+func (a *fakeAction) Cooldown() time.Duration { return a.cooldown }
+
+func (a *fakeAction) RateLimit() (int, time.Duration) { return a.rateLimit, time.Minute }
+
+func Test_scheduler(t *testing.T) {
+	add := deviceevent.New(deviceevent.Add, device.New("/devices/1"))
+
+	tests := []struct {
+		name    string
+		actions []*fakeAction
+		// The event for the second run, ADD /devices/2 by default.
+		second deviceevent.IDeviceEvent
+		// Whether the second run starts while the first one goes on.
+		concurrent bool
+		want       []string
+	}{
+		{
+			name:       "parallel",
+			actions:    []*fakeAction{{concurrency: action.ConcurrencyParallel}},
+			concurrent: true,
+			want:       []string{"start /devices/1", "start /devices/2", "end /devices/1", "end /devices/2"},
+		},
+		{
+			name:    "queue",
+			actions: []*fakeAction{{concurrency: action.ConcurrencyQueue}},
+			want:    []string{"start /devices/1", "end /devices/1", "start /devices/2", "end /devices/2"},
+		},
+		{
+			name:    "replace",
+			actions: []*fakeAction{{concurrency: action.ConcurrencyReplace}},
+			want:    []string{"start /devices/1", "cancel /devices/1", "start /devices/2", "end /devices/2"},
+		},
+		{
+			name:    "skip",
+			actions: []*fakeAction{{concurrency: action.ConcurrencySkip}},
+			want:    []string{"start /devices/1", "end /devices/1"},
+		},
+		{
+			name:       "device",
+			actions:    []*fakeAction{{concurrency: action.ConcurrencyDevice}},
+			concurrent: true,
+			want:       []string{"start /devices/1", "start /devices/2", "end /devices/1", "end /devices/2"},
+		},
+		{
+			name:    "same device",
+			actions: []*fakeAction{{concurrency: action.ConcurrencyDevice}},
+			second:  deviceevent.New(deviceevent.Change, device.New("/devices/1")),
+			want: []string{
+				"start /devices/1", "end /devices/1", "start /devices/1 CHANGE", "end /devices/1 CHANGE"},
+		},
+		{
+			name: "lock",
+			actions: []*fakeAction{
+				{concurrency: action.ConcurrencyParallel, lock: "display"},
+				{concurrency: action.ConcurrencyParallel, lock: "display"},
+			},
+			want: []string{"start /devices/1", "end /devices/1", "start /devices/2", "end /devices/2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipe := messagepipe.New(false)
+			s := newScheduler(&pipe)
+			log := &runLog{}
+
+			events := []deviceevent.IDeviceEvent{add, tt.second}
+			if tt.second == nil {
+				events[1] = deviceevent.New(deviceevent.Add, device.New("/devices/2"))
+			}
+			releases := make(map[string]chan struct{})
+			for _, event := range events {
+				releases[runLabel(event)] = make(chan struct{})
+			}
+			for _, a := range tt.actions {
+				a.log, a.releases = log, releases
+			}
+
+			// The first action runs for the first event, the last one for
+			// the second event, which comes while the first run goes on.
+			var wg sync.WaitGroup
+			runs := make([]*run, len(events))
+			for i, event := range events {
+				a := tt.actions[i*(len(tt.actions)-1)]
+				name := "test"
+				if len(tt.actions) > 1 {
+					name += event.Device().Path()
+				}
+
+				runs[i] = s.schedule(context.Background(), name, a, event)
+				if runs[i] != nil {
+					wg.Add(1)
+					go func(r *run) {
+						defer wg.Done()
+						s.start(r, nil)
+					}(runs[i])
+				}
+				if i == 0 || tt.concurrent {
+					log.wait(t, "start "+runLabel(event))
+				}
+			}
+
+			close(releases[runLabel(events[0])])
+			<-runs[0].done
+			close(releases[runLabel(events[1])])
+			wg.Wait()
+
+			if got := log.get(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("runs = %v, want %v", got, tt.want)
+			}
+			if len(s.actions) > 0 || len(s.locks) > 0 {
+				t.Errorf("scheduler still tracks %v and %v", s.actions, s.locks)
+			}
+		})
+	}
+}
+
+func Test_scheduler_throttle(t *testing.T) {
+	pipe := messagepipe.New(false)
+	s := newScheduler(&pipe)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	cooled := &fakeAction{cooldown: 100 * time.Millisecond}
+	limited := &fakeAction{rateLimit: 2}
+	event := func(path string) deviceevent.IDeviceEvent {
+		return deviceevent.New(deviceevent.Add, device.New(path))
+	}
+
+	tests := []struct {
+		name           string
+		action         *fakeAction
+		path           string
+		advance        time.Duration
+		wantSuppressed int
+		wantAllowed    bool
+	}{
+		{name: "first", action: cooled, path: "/devices/1", wantAllowed: true},
+		{name: "same device", action: cooled, path: "/devices/1"},
+		{name: "same device again", action: cooled, path: "/devices/1"},
+		{name: "other device", action: cooled, path: "/devices/2", wantAllowed: true},
+		{name: "almost cooled down", action: cooled, path: "/devices/1", advance: 99 * time.Millisecond},
+		{
+			name: "cooled down", action: cooled, path: "/devices/1",
+			advance: time.Millisecond, wantSuppressed: 3, wantAllowed: true,
+		},
+		{name: "within limit", action: limited, path: "/devices/1", wantAllowed: true},
+		{name: "at limit", action: limited, path: "/devices/2", wantAllowed: true},
+		{name: "over limit", action: limited, path: "/devices/3"},
+		{
+			name: "next period", action: limited, path: "/devices/3",
+			advance: time.Minute, wantSuppressed: 1, wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+
+		name := "cooled"
+		if tt.action == limited {
+			name = "limited"
+		}
+		suppressed, allowed := s.throttle(name, tt.action, event(tt.path))
+		if suppressed != tt.wantSuppressed || allowed != tt.wantAllowed {
+			t.Errorf("%s: throttle() = %d, %v, want %d, %v",
+				tt.name, suppressed, allowed, tt.wantSuppressed, tt.wantAllowed)
+		}
+	}
+}
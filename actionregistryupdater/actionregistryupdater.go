@@ -17,7 +17,11 @@ type ActionRegistryUpdater struct {
 	monitor  confmonitor.IConfMonitor
 	pipe     messagepipe.IMessagePipe
 
-	done chan bool
+	// The registry keys of the actions of each config file.
+	keys map[string][]string
+
+	done   chan bool
+	loaded chan struct{}
 }
 
 // New creates a new ActionRegistryUpdater.
@@ -34,49 +38,84 @@ func New(
 
 // Start starts the ActionRegistryUpdater loop. Yeah.
 func (aru *ActionRegistryUpdater) Start() error {
+	aru.loaded = make(chan struct{})
 	err := aru.monitor.Start()
 	if err != nil {
+		// Nothing to wait for.
+		close(aru.loaded)
 		return err
 	}
 
 	aru.done = make(chan bool)
+	aru.keys = make(map[string][]string)
+	done, loaded := aru.done, aru.loaded
 
 	go func() {
 		events := aru.monitor.Events()
+		monitorLoaded := aru.monitor.Loaded()
+		// Not to leave anyone waiting if the loop ends first.
+		defer func() {
+			if monitorLoaded != nil {
+				close(loaded)
+			}
+		}()
 	out:
 		for {
 
 			select {
-			case <-aru.done:
+			case <-done:
 				break out
 
+			case <-monitorLoaded:
+				// The events before it have all been handled by now.
+				close(loaded)
+				monitorLoaded = nil
+
 			case event, ok := <-events:
 				if !ok {
 					break out
 				}
 
-				name := path.Base(event.Name)
+				name := event.Name
+
+				// The shared variables are not actions, wherever they are.
+				// Configs depend on them, so they get reloaded when the
+				// variables change.
+				if path.Base(name) == action.VarsFile {
+					continue
+				}
 
 				if event.Event == confmonitor.FileDelete {
 					aru.pipe.Info(fmt.Sprint("Conf file removed: ", name))
-					aru.registry.Remove(name)
+					aru.update(name, nil)
 
 				} else { // Create or Update
-					action, err := action.NewActionFromFile(event.Name)
+					vars, err := action.LoadVars(aru.monitor.Lookup(action.VarsFile))
+					if err != nil {
+						aru.pipe.Error(fmt.Errorf(
+							"Error while reading %s: %s", event.Path, err))
+						continue
+					}
+
+					actions, err := action.NewActionsFromFile(event.Path, vars)
 
 					if err != nil {
 						aru.pipe.Error(fmt.Errorf(
-							"Error while reading %s: %s", event.Name, err))
+							"Error while reading %s: %s", event.Path, err))
 						continue
 					}
 
+					for _, warning := range actions[0].Warnings() {
+						aru.pipe.Info(warning.String())
+					}
+
 					if event.Event == confmonitor.FileCreate {
 						aru.pipe.Info(fmt.Sprint("Conf file added: ", name))
 					} else { // Event is FileChange
 						aru.pipe.Info(fmt.Sprint("Conf file modified: ", name))
 					}
 
-					aru.registry.Update(name, action)
+					aru.update(name, actions)
 				}
 			}
 		}
@@ -87,6 +126,46 @@ func (aru *ActionRegistryUpdater) Start() error {
 	return nil
 }
 
+// Loaded returns a channel that gets closed once the actions of the config
+// files present at startup are in the registry.
+func (aru *ActionRegistryUpdater) Loaded() <-chan struct{} {
+	return aru.loaded
+}
+
+// update replaces the actions of the given config file in the registry with
+// the given ones. Actions are keyed as "file" for a plain [action] section, and
+// "file:name" for an [action "name"] section.
+func (aru *ActionRegistryUpdater) update(file string, actions []*action.Action) {
+
+	var keys []string
+	for _, a := range actions {
+		key := file
+		if a.Name() != "" {
+			key += ":" + a.Name()
+		}
+
+		aru.registry.Update(key, a)
+		keys = append(keys, key)
+	}
+
+	for _, previous := range aru.keys[file] {
+		stale := true
+		for _, key := range keys {
+			stale = stale && key != previous
+		}
+		if stale {
+			aru.pipe.Debug(fmt.Sprint("Action removed: ", previous))
+			aru.registry.Remove(previous)
+		}
+	}
+
+	if len(keys) > 0 {
+		aru.keys[file] = keys
+	} else {
+		delete(aru.keys, file)
+	}
+}
+
 // Stop stops the ActionRegistryUpdater loop.
 func (aru *ActionRegistryUpdater) Stop() {
 
@@ -1,19 +1,30 @@
 package confmonitor
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 
 	"onplugd/messagepipe"
+	"onplugd/utils"
 )
 
 // FileEventType characterizes an event that can happen on a file.
 type FileEventType uint8
 
-const confPattern = "*.conf"
+// DefaultPatterns are the file name patterns of the config files, unless set
+// otherwise with SetPatterns.
+var DefaultPatterns = []string{"*.conf"}
+
+// SystemConfigDir is the system-wide config directory.
+const SystemConfigDir = "/etc/onplugd.d"
 
 const (
 	// FileCreate is the event that indicates a file creation.
@@ -27,23 +38,99 @@ const (
 // FileEvent captures an event on a file.
 type FileEvent struct {
 	Event FileEventType
-	Name  string
+	// Name is the path of the file relative to the config directory it was
+	// found in. Files with the same name in different config directories
+	// override each other.
+	Name string
+	// Path is the full path of the file.
+	Path string
 }
 
-// ConfMonitor is an fsnotify-based implementation of IConfMonitor.
+// How long to wait for the filesystem to settle after an event before looking
+// at what changed. Editors typically save files in several steps (write to a
+// temporary file, rename it over the original...) and we only want to see
+// the end result.
+const debounceDelay = 200 * time.Millisecond
+
+// confFile is a config file in effect.
+type confFile struct {
+	path string
+	sum  string
+}
+
+// ConfMonitor is an fsnotify-based implementation of IConfMonitor. It
+// monitors a search path of config directories and their subdirectories.
 type ConfMonitor struct {
-	path    string
+	paths   []string
 	events  chan FileEvent
 	done    chan bool
 	started bool
 	pipe    messagepipe.IMessagePipe
+	watcher *fsnotify.Watcher
+
+	// The config files currently in effect, by name.
+	files map[string]confFile
+	// The paths currently watched.
+	watches map[string]bool
+	// The targets of symlinked config files, and the files they depend on.
+	targets map[string]bool
+	// Closed once the files present at startup have been reported.
+	loaded chan struct{}
+
+	patterns     []string
+	dependencies func(string) []string
 }
 
-// New creates a new ConfMonitor.
+// DefaultSearchPath returns the directories where configs are looked up by
+// default, from lowest to highest precedence: the system-wide directory, then
+// the XDG config directories, then the user's own directory.
+func DefaultSearchPath() []string {
+	paths := []string{SystemConfigDir}
+
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg"
+	}
+
+	// XDG_CONFIG_DIRS is ordered from highest to lowest precedence.
+	dirs := strings.Split(configDirs, ":")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i] != "" {
+			paths = append(paths, path.Join(dirs[i], "onplugd.d"))
+		}
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = utils.Expand("~/.config")
+	}
+
+	return append(paths, path.Join(configHome, "onplugd.d"))
+}
+
+// New creates a new ConfMonitor for the given config directories, from lowest
+// to highest precedence.
 func New(
-	path string, pipe messagepipe.IMessagePipe) ConfMonitor {
+	paths []string, pipe messagepipe.IMessagePipe) ConfMonitor {
+
+	var cleaned []string
+	for _, p := range paths {
+		cleaned = append(cleaned, filepath.Clean(p))
+	}
+
+	return ConfMonitor{paths: cleaned, pipe: pipe, patterns: DefaultPatterns}
+}
+
+// SetPatterns sets the file name patterns of the config files.
+func (m *ConfMonitor) SetPatterns(patterns []string) {
+	m.patterns = patterns
+}
 
-	return ConfMonitor{path: path, pipe: pipe}
+// SetDependencies sets the function that lists the files a config file
+// depends on, for instance because it includes them. A config file is
+// considered changed when any of its dependencies changes.
+func (m *ConfMonitor) SetDependencies(dependencies func(string) []string) {
+	m.dependencies = dependencies
 }
 
 // Start sets up the monitor and starts the monitoring goroutine.
@@ -52,15 +139,20 @@ func (m *ConfMonitor) Start() error {
 		return nil
 	}
 
-	if _, err := path.Match("", confPattern); err != nil {
-		// Invalid pattern.
-		return err
+	for _, pattern := range m.patterns {
+		if _, err := path.Match("", pattern); err != nil {
+			// Invalid pattern.
+			return err
+		}
 	}
 
 	m.Stop()
 
-	if _, err := os.Stat(m.path); os.IsNotExist(err) {
-		err = os.MkdirAll(m.path, 0755)
+	// Only the directory with the highest precedence is ours to create; the
+	// others are optional.
+	userPath := m.paths[len(m.paths)-1]
+	if _, err := os.Stat(userPath); os.IsNotExist(err) {
+		err = os.MkdirAll(userPath, 0755)
 		if err != nil {
 			return err
 		}
@@ -68,26 +160,30 @@ func (m *ConfMonitor) Start() error {
 
 	m.done = make(chan bool)
 	m.events = make(chan FileEvent)
+	m.loaded = make(chan struct{})
+	m.files = make(map[string]confFile)
+	m.watches = make(map[string]bool)
+	m.targets = make(map[string]bool)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-
-	watcher.Add(m.path)
+	m.watcher = watcher
+	done, loaded := m.done, m.loaded
 
 	go func() {
 
 		// Populate existing files.
-		files, _ := filepath.Glob(path.Join(m.path, confPattern))
-		for _, f := range files {
-			m.events <- FileEvent{Event: FileCreate, Name: f}
-		}
+		m.reconcile()
+		close(loaded)
+
+		var settled <-chan time.Time
 
 	out:
 		for {
 			select {
-			case <-m.done:
+			case <-done:
 				break out
 
 			case event, ok := <-watcher.Events:
@@ -95,26 +191,24 @@ func (m *ConfMonitor) Start() error {
 					break out
 				}
 
-				// Only match events on paths that have the proper suffix.
-				if matching, err := path.Match(
-					confPattern, path.Base(event.Name)); !matching || err != nil {
-					continue
+				if m.relevant(event.Name) {
+					m.pipe.Debug(fmt.Sprint("ConfMonitor: ", event))
+					settled = time.After(debounceDelay)
 				}
 
-				if event.Op&fsnotify.Create != 0 {
-					m.events <- FileEvent{Event: FileCreate, Name: event.Name}
-				} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-					m.events <- FileEvent{Event: FileDelete, Name: event.Name}
-				} else if event.Op&fsnotify.Write != 0 {
-					m.events <- FileEvent{Event: FileChange, Name: event.Name}
-				}
+			case <-settled:
+				settled = nil
+				m.reconcile()
 
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					break out
 				}
 
+				// We may have missed events (for instance if the kernel queue
+				// overflowed), so look for changes anyway.
 				m.pipe.Error(err)
+				settled = time.After(debounceDelay)
 			}
 		}
 
@@ -145,3 +239,260 @@ func (m *ConfMonitor) Events() <-chan FileEvent {
 	m.Start()
 	return m.events
 }
+
+// Loaded returns a channel that gets closed once the events for the config
+// files present when the monitor started have all been received.
+func (m *ConfMonitor) Loaded() <-chan struct{} {
+	return m.loaded
+}
+
+// reconcile compares the config files currently on disk with the ones we know
+// about, and emits events for the differences. It also updates the watches to
+// match the current state of the directories.
+func (m *ConfMonitor) reconcile() {
+
+	watches := make(map[string]bool)
+	targets := make(map[string]bool)
+	names := make(map[string]bool)
+
+	for _, p := range m.paths {
+		if _, err := os.Stat(p); err != nil {
+			// Watch the closest existing parent, so we notice when the
+			// directory gets (re)created.
+			watches[existingParent(p)] = true
+			continue
+		}
+
+		for _, name := range m.walk(p, watches) {
+			names[name] = true
+		}
+	}
+
+	files := make(map[string]confFile)
+	for name := range names {
+		fullpath := m.Lookup(name)
+		if fullpath == "" {
+			continue
+		}
+
+		content, err := os.ReadFile(fullpath)
+		if err != nil {
+			if _, known := m.files[name]; known {
+				m.pipe.Error(err)
+			}
+			continue
+		}
+
+		sum := sha256.New()
+		sum.Write(content)
+
+		if m.dependencies != nil {
+			for _, dep := range m.dependencies(fullpath) {
+				// Missing dependencies are worth watching too, since they may
+				// show up later.
+				content, _ := os.ReadFile(dep)
+				fmt.Fprintf(sum, "\x00%s\x00%d\x00", dep, len(content))
+				sum.Write(content)
+
+				targets[dep] = true
+				watches[existingParent(dep)] = true
+			}
+		}
+
+		files[name] = confFile{path: fullpath, sum: string(sum.Sum(nil))}
+
+		// Watch the targets of symlinks, which may live elsewhere.
+		if target, err := filepath.EvalSymlinks(fullpath); err == nil &&
+			target != fullpath {
+			targets[target] = true
+			watches[filepath.Dir(target)] = true
+		}
+	}
+
+	m.updateWatches(watches)
+	m.targets = targets
+
+	var sorted []string
+	for name := range m.files {
+		if _, found := files[name]; !found {
+			sorted = append(sorted, name)
+		}
+	}
+	for name := range files {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		previous, known := m.files[name]
+		current, found := files[name]
+
+		switch {
+		case known && !found:
+			m.events <- FileEvent{Event: FileDelete, Name: name, Path: previous.path}
+
+		case !known && found:
+			m.events <- FileEvent{Event: FileCreate, Name: name, Path: current.path}
+
+		case previous != current:
+			m.events <- FileEvent{Event: FileChange, Name: name, Path: current.path}
+		}
+	}
+
+	m.files = files
+}
+
+// updateWatches adds and removes watches so that exactly the given paths are
+// watched.
+func (m *ConfMonitor) updateWatches(watches map[string]bool) {
+
+	for p := range watches {
+		if !m.watches[p] {
+			if err := m.watcher.Add(p); err != nil {
+				m.pipe.Error(err)
+				delete(watches, p)
+			}
+		}
+	}
+
+	for p := range m.watches {
+		if !watches[p] {
+			// The watch may already be gone along with the directory, so
+			// errors are expected here.
+			m.watcher.Remove(p)
+		}
+	}
+
+	m.watches = watches
+}
+
+// relevant reports whether an event on the given path may affect the configs.
+func (m *ConfMonitor) relevant(fullpath string) bool {
+
+	if m.targets[fullpath] {
+		return true
+	}
+
+	for _, p := range m.paths {
+		// The event is either on a config directory or something it contains,
+		// or on one of its parents getting created or removed.
+		if fullpath == p || strings.HasPrefix(fullpath, p+"/") ||
+			strings.HasPrefix(p, fullpath+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lookup returns the path of the file in effect for the given name, or an
+// empty string if there is none, or if it is masked.
+func (m *ConfMonitor) Lookup(name string) string {
+	return Lookup(m.paths, name)
+}
+
+// Lookup returns the path of the file in effect for the given name in the
+// given config directories, from lowest to highest precedence, or an empty
+// string if there is none, or if it is masked.
+func Lookup(paths []string, name string) string {
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		fullpath := filepath.Join(paths[i], name)
+
+		info, err := os.Stat(fullpath)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		if isMask(fullpath, info) {
+			return ""
+		}
+
+		return fullpath
+	}
+
+	return ""
+}
+
+// relativeName returns the name of the given path relative to the config
+// directory that contains it.
+func (m *ConfMonitor) relativeName(fullpath string) (string, bool) {
+
+	for _, p := range m.paths {
+		rel, err := filepath.Rel(p, fullpath)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return rel, true
+		}
+	}
+
+	return "", false
+}
+
+// walk lists the directories under the given config directory into the given
+// watch set, and returns the names of the configs found there.
+func (m *ConfMonitor) walk(dir string, watches map[string]bool) []string {
+
+	var names []string
+
+	filepath.Walk(dir, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Missing or unreadable: skip it.
+			return nil
+		}
+
+		if info.IsDir() {
+			watches[fullpath] = true
+			return nil
+		}
+
+		if m.isConf(fullpath) {
+			if name, ok := m.relativeName(fullpath); ok {
+				names = append(names, name)
+			}
+		}
+
+		return nil
+	})
+
+	return names
+}
+
+// existingParent returns the closest parent of the given path that exists.
+func existingParent(fullpath string) string {
+	for {
+		parent := filepath.Dir(fullpath)
+		if _, err := os.Stat(parent); err == nil || parent == fullpath {
+			return parent
+		}
+		fullpath = parent
+	}
+}
+
+// isConf reports whether the given path looks like a config file.
+func (m *ConfMonitor) isConf(fullpath string) bool {
+	for _, pattern := range m.patterns {
+		if matching, err := path.Match(pattern, path.Base(fullpath)); matching && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMask reports whether the given config file is a mask, which disables the
+// files with the same name in lower precedence directories.
+func IsMask(fullpath string) bool {
+	info, err := os.Stat(fullpath)
+	return err == nil && isMask(fullpath, info)
+}
+
+// isMask reports whether the given file disables the files with the same name
+// in lower precedence directories, i.e. if it is empty or a link to /dev/null.
+func isMask(fullpath string, info os.FileInfo) bool {
+
+	if target, err := filepath.EvalSymlinks(fullpath); err == nil &&
+		target == os.DevNull {
+		return true
+	}
+
+	return info.Mode().IsRegular() && info.Size() == 0
+}
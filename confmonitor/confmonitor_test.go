@@ -0,0 +1,149 @@
+package confmonitor
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"onplugd/messagepipe"
+)
+
+func writeFile(t *testing.T, fullpath string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(path.Dir(fullpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect checks that the next event from the channel is the wanted one.
+func expect(t *testing.T, events <-chan FileEvent, want FileEvent) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %+v", want)
+	}
+}
+
+func Test_ConfMonitor(t *testing.T) {
+	system, user := t.TempDir(), t.TempDir()
+
+	writeFile(t, path.Join(system, "a.conf"), "[action]\nexec = a\n")
+	writeFile(t, path.Join(system, "b.conf"), "[action]\nexec = b\n")
+	writeFile(t, path.Join(system, "host/c.conf"), "[action]\nexec = c\n")
+	writeFile(t, path.Join(user, "a.conf"), "[action]\nexec = user a\n")
+	writeFile(t, path.Join(user, "b.conf"), "")
+
+	pipe := messagepipe.New(false)
+	m := New([]string{system, user}, &pipe)
+	events := m.Events()
+	defer m.Stop()
+
+	// Initial population: the user's a.conf overrides the system's, the empty
+	// b.conf masks the system's, and subdirectories are walked.
+	var got []FileEvent
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out, got %+v", got)
+		}
+	}
+	want := []FileEvent{
+		{Event: FileCreate, Name: "a.conf", Path: path.Join(user, "a.conf")},
+		{Event: FileCreate, Name: "host/c.conf", Path: path.Join(system, "host/c.conf")},
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	select {
+	case <-m.Loaded():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the initial population to be over")
+	}
+
+	// Removing the override brings the system config back into effect.
+	os.Remove(path.Join(user, "a.conf"))
+	expect(t, events, FileEvent{
+		Event: FileChange, Name: "a.conf", Path: path.Join(system, "a.conf")})
+
+	// Masking with a link to /dev/null.
+	os.Symlink(os.DevNull, path.Join(user, "a.conf"))
+	expect(t, events, FileEvent{
+		Event: FileDelete, Name: "a.conf", Path: path.Join(system, "a.conf")})
+
+	// New subdirectories get watched too.
+	writeFile(t, path.Join(user, "host/d.conf"), "[action]\nexec = d\n")
+	expect(t, events, FileEvent{
+		Event: FileCreate, Name: "host/d.conf", Path: path.Join(user, "host/d.conf")})
+}
+
+func Test_ConfMonitorRobustness(t *testing.T) {
+	dir := path.Join(t.TempDir(), "onplugd.d")
+	elsewhere := t.TempDir()
+	conf := path.Join(dir, "a.conf")
+
+	writeFile(t, conf, "[action]\nexec = a\n")
+
+	pipe := messagepipe.New(false)
+	m := New([]string{dir}, &pipe)
+	events := m.Events()
+	defer m.Stop()
+
+	expect(t, events, FileEvent{Event: FileCreate, Name: "a.conf", Path: conf})
+
+	// An atomic save, the way editors do it, is a mere change.
+	writeFile(t, conf+".swp", "[action]\nexec = b\n")
+	os.Rename(conf+".swp", conf)
+	expect(t, events, FileEvent{Event: FileChange, Name: "a.conf", Path: conf})
+
+	// Symlinked configs are followed to their target.
+	target := path.Join(elsewhere, "target.conf")
+	writeFile(t, target, "[action]\nexec = c\n")
+	os.Remove(conf)
+	os.Symlink(target, conf)
+	expect(t, events, FileEvent{Event: FileChange, Name: "a.conf", Path: conf})
+
+	writeFile(t, target, "[action]\nexec = d\n")
+	expect(t, events, FileEvent{Event: FileChange, Name: "a.conf", Path: conf})
+
+	// Replacing the whole directory.
+	os.RemoveAll(dir)
+	expect(t, events, FileEvent{Event: FileDelete, Name: "a.conf", Path: conf})
+
+	writeFile(t, conf, "[action]\nexec = e\n")
+	expect(t, events, FileEvent{Event: FileCreate, Name: "a.conf", Path: conf})
+}
+
+func Test_ConfMonitorDependencies(t *testing.T) {
+	dir, elsewhere := t.TempDir(), t.TempDir()
+	conf := path.Join(dir, "a.conf")
+	inc := path.Join(elsewhere, "common.inc")
+
+	writeFile(t, conf, "include = "+inc+"\n")
+
+	pipe := messagepipe.New(false)
+	m := New([]string{dir}, &pipe)
+	m.SetDependencies(func(string) []string { return []string{inc} })
+	events := m.Events()
+	defer m.Stop()
+
+	expect(t, events, FileEvent{Event: FileCreate, Name: "a.conf", Path: conf})
+
+	// Dependencies are tracked even before they exist.
+	writeFile(t, inc, "[template \"t\"]\nexec = a\n")
+	expect(t, events, FileEvent{Event: FileChange, Name: "a.conf", Path: conf})
+
+	writeFile(t, inc, "[template \"t\"]\nexec = b\n")
+	expect(t, events, FileEvent{Event: FileChange, Name: "a.conf", Path: conf})
+}
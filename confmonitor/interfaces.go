@@ -5,4 +5,6 @@ type IConfMonitor interface {
 	Start() error
 	Stop()
 	Events() <-chan FileEvent
+	Loaded() <-chan struct{}
+	Lookup(name string) string
 }
@@ -1,8 +1,11 @@
 package device
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"sort"
+	"strings"
 )
 
 // Device is an implementation of IDevice.
@@ -92,3 +95,62 @@ func New(path string) *Device {
 		uevent: make(map[string]string),
 	}
 }
+
+// headerRegexp matches the first line of the output of Debug(), i.e. the
+// output of String(), optionally preceded by a log prefix.
+var headerRegexp = regexp.MustCompile(
+	`\[(.*)\] \(([^)]*)\)(?: type:(\S+))?(?: driver:(\S+))?\s*$`)
+
+// Parse recreates a device from a dump of its Debug() output, for instance as
+// found in the logs of a debug run.
+func Parse(dump string) (*Device, error) {
+
+	lines := strings.Split(dump, "\n")
+
+	header := headerRegexp.FindStringSubmatch(lines[0])
+	if header == nil {
+		return nil, errors.New("Not a device dump: no device header found")
+	}
+
+	d := New(header[1])
+	d.SetSubsystem(header[2])
+	d.SetType(header[3])
+	d.SetDriver(header[4])
+
+	var section map[string]string
+	var lastKey string
+	inAttrs := false
+
+	for _, line := range lines[1:] {
+		switch {
+		case line == "" && !inAttrs:
+			// The dump ends with an empty line, after the uevent properties.
+			// Attribute values, which may be binary, can hold empty lines.
+			return d, nil
+
+		case line == "ATTRS:":
+			section = d.attrs
+			lastKey = ""
+			inAttrs = true
+
+		case line == "UEVENT:":
+			section = d.uevent
+			lastKey = ""
+			inAttrs = false
+
+		case section == nil:
+			continue
+
+		case strings.HasPrefix(line, "  ") && strings.Contains(line, "="):
+			keyvalue := strings.SplitN(strings.TrimPrefix(line, "  "), "=", 2)
+			lastKey = keyvalue[0]
+			section[lastKey] = keyvalue[1]
+
+		case lastKey != "":
+			// Values may span several lines.
+			section[lastKey] += "\n" + line
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,90 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		dump    string
+		want    *Device
+		wantErr bool
+	}{
+		{
+			name: "debug output",
+			dump: "[/devices/usb1] (usb) type:usb_device driver:usb\n" +
+				"ATTRS:\n  idVendor=046d\n  product=Mouse\n" +
+				"UEVENT:\n  DEVTYPE=usb_device\n\n",
+			want: &Device{
+				path: "/devices/usb1", subsystem: "usb", typ: "usb_device", driver: "usb",
+				attrs:  map[string]string{"idVendor": "046d", "product": "Mouse"},
+				uevent: map[string]string{"DEVTYPE": "usb_device"},
+			},
+		},
+		{
+			name: "log prefix and trailing lines",
+			dump: "2024/01/02 03:04:05 [/devices/usb1] (usb)\n" +
+				"ATTRS:\n  idVendor=046d\nUEVENT:\n  DEVTYPE=usb_device\n\nMatch found: mouse.conf\n",
+			want: &Device{
+				path: "/devices/usb1", subsystem: "usb",
+				attrs:  map[string]string{"idVendor": "046d"},
+				uevent: map[string]string{"DEVTYPE": "usb_device"},
+			},
+		},
+		{
+			name: "multi-line attribute with empty lines",
+			dump: "[/devices/usb1] (usb)\n" +
+				"ATTRS:\n  descriptors=\x12\x01\n\n\x00\x02\n  idVendor=046d\n" +
+				"UEVENT:\n  DEVTYPE=usb_device\n\n",
+			want: &Device{
+				path: "/devices/usb1", subsystem: "usb",
+				attrs:  map[string]string{"descriptors": "\x12\x01\n\n\x00\x02", "idVendor": "046d"},
+				uevent: map[string]string{"DEVTYPE": "usb_device"},
+			},
+		},
+		{
+			name: "no trailing empty line",
+			dump: "[/devices/usb1] (usb)\nATTRS:\nUEVENT:\n  DEVTYPE=usb_device",
+			want: &Device{
+				path: "/devices/usb1", subsystem: "usb",
+				attrs:  map[string]string{},
+				uevent: map[string]string{"DEVTYPE": "usb_device"},
+			},
+		},
+		{
+			name:    "no header",
+			dump:    "ATTRS:\n  idVendor=046d\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.dump)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ParseDebug(t *testing.T) {
+	d := New("/devices/usb1")
+	d.SetSubsystem("usb")
+	d.SetDriver("usb")
+	d.attrs["descriptors"] = "\x12\x01\n\n\x00\x02\n"
+	d.attrs["idProduct"] = "c52b"
+	d.uevent["DEVTYPE"] = "usb_device"
+
+	got, err := Parse(d.Debug())
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("Parse(Debug()) = %#v, want %#v", got, d)
+	}
+}
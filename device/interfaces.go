@@ -2,6 +2,10 @@ package device
 
 import "fmt"
 
+// MonitoredSubsystems lists the udev subsystems of the devices that onplugd
+// monitors. For now, only USB and input devices.
+var MonitoredSubsystems = []string{"usb", "input"}
+
 // IDevice is the interface that describes the properties of a device.
 type IDevice interface {
 	fmt.Stringer
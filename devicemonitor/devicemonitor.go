@@ -21,8 +21,8 @@ const netlinkUdev = "udev"
 // properties.
 const ueventAttr = "uevent"
 
-// For now, only monitor USB and input device events.
-var monitoredSubsystems = [...]string{"usb", "input"}
+// Devpaths are relative to where sysfs is mounted.
+const sysfsRoot = "/sys"
 
 // UdevDeviceMonitor is an udev-based implementation of IDeviceMonitor.
 type UdevDeviceMonitor struct {
@@ -44,7 +44,7 @@ func (m *UdevDeviceMonitor) Start() error {
 	udev := udev.Udev{}
 	monitor := udev.NewMonitorFromNetlink(netlinkUdev)
 
-	for _, subsystem := range monitoredSubsystems {
+	for _, subsystem := range device.MonitoredSubsystems {
 		err := monitor.FilterAddMatchSubsystem(subsystem)
 		if err != nil {
 			return err
@@ -96,7 +96,7 @@ func (m *UdevDeviceMonitor) doColdPlug(udev *udev.Udev) error {
 		return err
 	}
 
-	for _, subsystem := range monitoredSubsystems {
+	for _, subsystem := range device.MonitoredSubsystems {
 		err = enumerate.AddMatchSubsystem(subsystem)
 		if err != nil {
 			return err
@@ -148,20 +148,7 @@ func (m UdevDeviceMonitor) processEvent(event deviceevent.Event, dev *udev.Devic
 		delete(m.records, d.Path())
 	}
 
-	attrs := attrsFromUdevDevice(dev)
-	uevent := ueventFromAttrs(attrs)
-
-	d.SetSubsystem(dev.Subsystem())
-	d.SetType(dev.Devtype())
-	d.SetDriver(dev.Driver())
-
-	for k, v := range attrs {
-		d.Attrs()[k] = v
-	}
-
-	for k, v := range uevent {
-		d.Uevent()[k] = v
-	}
+	populate(d, dev)
 
 	e := deviceevent.New(event, d)
 
@@ -219,16 +206,53 @@ func New(pipe messagepipe.IMessagePipe) UdevDeviceMonitor {
 	return UdevDeviceMonitor{pipe: pipe}
 }
 
-func checkSubsystem(device *udev.Device) error {
+// Lookup returns the current state of the device with the given devpath. The
+// devpath may also be given as a full sysfs path.
+func Lookup(devpath string) (device.IDevice, error) {
+
+	udev := udev.Udev{}
+	devpath = strings.TrimPrefix(devpath, sysfsRoot)
+	dev := udev.NewDeviceFromSyspath(sysfsRoot + devpath)
+	if dev == nil {
+		return nil, fmt.Errorf("No such device: %s", devpath)
+	}
+
+	d := device.New(dev.Devpath())
+	populate(d, dev)
+
+	return d, nil
+}
+
+// populate updates the given device with the properties of the given
+// udev.Device.
+func populate(d device.IDevice, dev *udev.Device) {
+
+	attrs := attrsFromUdevDevice(dev)
+	uevent := ueventFromAttrs(attrs)
+
+	d.SetSubsystem(dev.Subsystem())
+	d.SetType(dev.Devtype())
+	d.SetDriver(dev.Driver())
+
+	for k, v := range attrs {
+		d.Attrs()[k] = v
+	}
+
+	for k, v := range uevent {
+		d.Uevent()[k] = v
+	}
+}
+
+func checkSubsystem(dev *udev.Device) error {
 
-	for _, expectedSubsystem := range monitoredSubsystems {
-		if device.Subsystem() == expectedSubsystem {
+	for _, expectedSubsystem := range device.MonitoredSubsystems {
+		if dev.Subsystem() == expectedSubsystem {
 			return nil
 		}
 	}
 
 	return fmt.Errorf("Unexpected subsystem. Expected one of %v; got: %s",
-		monitoredSubsystems, device.Subsystem())
+		device.MonitoredSubsystems, dev.Subsystem())
 }
 
 func attrsFromUdevDevice(device *udev.Device) map[string]string {
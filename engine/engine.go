@@ -50,9 +50,12 @@ func (e *Engine) Start() error {
 	e.Stop()
 
 	// The order here matters: first we get ready to apply configurations, then we
-	// start reading configurations, then we start waiting for devices.
+	// start reading configurations, then we start waiting for devices. The
+	// devices already there get reported when the device monitor starts, so
+	// the configurations have to be loaded by then.
 	e.actionRegistryUpdater.Start()
 	e.confMonitor.Start()
+	<-e.actionRegistryUpdater.Loaded()
 	e.deviceMonitor.Start()
 
 	e.pipe.Debug("Engine started.")
@@ -68,6 +71,7 @@ func (e *Engine) Stop() error {
 		e.deviceMonitor.Stop()
 		e.confMonitor.Stop()
 		e.actionRegistryUpdater.Stop()
+		e.actionRegistry.Stop()
 		e.pipe.Debug("Engine stopped.")
 		e.started = false
 
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"onplugd/action"
+	"onplugd/confmonitor"
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/messagepipe"
+)
+
+// fakeConfMonitor reports the given config files from a goroutine, the way
+// ConfMonitor does at startup.
+type fakeConfMonitor struct {
+	files  map[string]string
+	events chan confmonitor.FileEvent
+	loaded chan struct{}
+}
+
+func (m *fakeConfMonitor) Start() error {
+	if m.events != nil {
+		return nil
+	}
+	m.events = make(chan confmonitor.FileEvent)
+	m.loaded = make(chan struct{})
+
+	go func() {
+		for name, fullpath := range m.files {
+			m.events <- confmonitor.FileEvent{Event: confmonitor.FileCreate, Name: name, Path: fullpath}
+		}
+		close(m.loaded)
+	}()
+	return nil
+}
+
+func (m *fakeConfMonitor) Stop() {}
+
+func (m *fakeConfMonitor) Events() <-chan confmonitor.FileEvent {
+	m.Start()
+	return m.events
+}
+
+func (m *fakeConfMonitor) Loaded() <-chan struct{} { return m.loaded }
+
+func (m *fakeConfMonitor) Lookup(name string) string { return "" }
+
+// fakeDeviceMonitor reports the given devices as present when it starts.
+type fakeDeviceMonitor struct {
+	paths     []string
+	callbacks []func(deviceevent.IDeviceEvent) error
+}
+
+func (m *fakeDeviceMonitor) Start() error {
+	for _, p := range m.paths {
+		for _, callback := range m.callbacks {
+			callback(deviceevent.New(deviceevent.Coldplug, device.New(p)))
+		}
+	}
+	return nil
+}
+
+func (m *fakeDeviceMonitor) Stop() error { return nil }
+
+func (m *fakeDeviceMonitor) AddCallback(f func(deviceevent.IDeviceEvent) error) {
+	m.callbacks = append(m.callbacks, f)
+}
+
+// fakeRegistry records the actions it gets and the events it sees.
+type fakeRegistry struct {
+	lock sync.Mutex
+	log  []string
+}
+
+func (r *fakeRegistry) add(entry string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.log = append(r.log, entry)
+}
+
+func (r *fakeRegistry) OnDeviceEvent(event deviceevent.IDeviceEvent) {
+	r.add(string(event.Event()) + " " + event.Device().Path())
+}
+
+func (r *fakeRegistry) Update(name string, a action.IAction) { r.add("update " + name) }
+func (r *fakeRegistry) Remove(name string)                   { r.add("remove " + name) }
+func (r *fakeRegistry) Stop()                                {}
+
+func Test_StartColdplug(t *testing.T) {
+	fullpath := path.Join(t.TempDir(), "a.conf")
+	if err := os.WriteFile(fullpath, []byte("[action]\nexec = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := messagepipe.New(false)
+	registry := &fakeRegistry{}
+	e := New(&fakeDeviceMonitor{paths: []string{"/devices/1"}},
+		&fakeConfMonitor{files: map[string]string{"a.conf": fullpath}}, registry, &pipe)
+
+	if err := e.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer e.Stop()
+
+	// The devices already there are matched against the configs already there.
+	registry.lock.Lock()
+	got := append([]string(nil), registry.log...)
+	registry.lock.Unlock()
+	if want := []string{"update a.conf", "COLDPLUG /devices/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registry got %v, want %v", got, want)
+	}
+}
@@ -1,61 +1,597 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
-	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"onplugd/messagepipe"
-	"onplugd/utils"
 )
 
+// DefaultKillAfter is how long a command that timed out has to terminate
+// before it gets killed, unless specified otherwise.
+const DefaultKillAfter = 5 * time.Second
+
+// shutdownTimeout is how long shutting down waits for the running commands to
+// terminate.
+const shutdownTimeout = 10 * time.Second
+
+// DefaultMaxRunning is how many commands may run at the same time, unless
+// specified otherwise.
+const DefaultMaxRunning = 32
+
 // An Executor can safely run a command line in a given context.
 type Executor struct {
 	pipe    messagepipe.IMessagePipe
 	context context.Context
+	// The commands currently running.
+	running sync.WaitGroup
+	// Holds a value for each running command, up to the maximum.
+	slots chan struct{}
 }
 
-// Exec runs the given command line with the given environment in a goroutine.
-// It returns as soon as the command is started without waiting for it to
-// complete.
-func (e *Executor) Exec(cmdline string, env []string, prefix string) {
+// SetMaxRunning sets how many commands may run at the same time, the others
+// waiting for their turn. It must be called before running any.
+func (e *Executor) SetMaxRunning(max int) {
+	e.slots = make(chan struct{}, max)
+}
 
-	cmdline = utils.Expand(cmdline)
-	cmd := exec.CommandContext(e.context, "/bin/sh", "-c", cmdline)
+// acquire waits for the given command to be allowed to run, and reports
+// whether it is.
+func (e *Executor) acquire(c Command) bool {
+	select {
+	case e.slots <- struct{}{}:
+		return true
+	default:
+	}
 
-	cmd.Env = env
-	cmd.Dir = path.Dir("/")
-	cmd.Stdin = nil // explicitly close stdin
+	e.pipe.Debug(fmt.Sprintf("%d commands running, %s waits for one of them to complete",
+		cap(e.slots), c.describe()))
 
-	e.pipe.Info(fmt.Sprintf("Executing '%s'", cmdline))
-	e.pipe.Debug(fmt.Sprintf("Environment: %v", env))
+	cancelled, aborted := c.done()
+	select {
+	case e.slots <- struct{}{}:
+		return true
+	case <-cancelled:
+		return false
+	case <-aborted:
+		return false
+	case <-e.context.Done():
+		return false
+	}
+}
 
-	go func() {
+func (e *Executor) release() {
+	<-e.slots
+}
+
+// Command describes a command to run.
+type Command struct {
+	// Args are the program to run and its arguments.
+	Args []string
+	// Script, if not empty, is written to a private temporary file whose path
+	// gets appended to Args, so that Args is typically an interpreter.
+	Script string
+	// Env is the environment of the command.
+	Env []string
+	// Dir is the working directory of the command, "/" if empty.
+	Dir string
+	// Stdin, if not nil, is fed to the standard input of the command.
+	Stdin []byte
+	// Timeout, if not zero, is how long the command may run before it gets
+	// terminated.
+	Timeout time.Duration
+	// KillAfter is how long a command that timed out has to terminate before
+	// it gets killed, DefaultKillAfter if zero.
+	KillAfter time.Duration
+	// Credential, if not nil, is who the command runs as instead of the
+	// daemon's user.
+	Credential *Credential
+	// Retry tells whether and how to run the command again when it fails.
+	Retry RetryPolicy
+	// Context, if not nil, cancels the pending retries of the command when
+	// done.
+	Context context.Context
+	// Abort, if not nil, terminates the command and cancels its pending
+	// retries when done.
+	Abort context.Context
+	// Prefix identifies the command in the logs.
+	Prefix string
+	// Origin tells where the command is defined, such as "foo.conf:12", for
+	// error messages.
+	Origin string
+}
+
+// done returns the channels closed when the contexts of the command are done,
+// nil for the contexts it doesn't have.
+func (c *Command) done() (cancelled <-chan struct{}, aborted <-chan struct{}) {
+	if c.Context != nil {
+		cancelled = c.Context.Done()
+	}
+	if c.Abort != nil {
+		aborted = c.Abort.Done()
+	}
+	return cancelled, aborted
+}
+
+// describe returns a short description of the command for the logs.
+func (c *Command) describe() string {
+	var description string
+	if c.Script != "" {
+		description = fmt.Sprintf("script run by '%s'", strings.Join(c.Args, " "))
+	} else {
+		description = fmt.Sprintf("'%s'", strings.Join(c.Args, " "))
+	}
+
+	if c.Origin != "" {
+		description += " (" + c.Origin + ")"
+	}
+	return description
+}
+
+// Credential is the identity a command runs as.
+type Credential struct {
+	Uid uint32
+	Gid uint32
+	// Groups are the supplementary groups of the command.
+	Groups []uint32
+	// User and Home are the name and home directory of the user, which end
+	// up in the USER, LOGNAME and HOME variables of the command.
+	User string
+	Home string
+}
+
+func (c *Credential) sys() *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    c.Uid,
+		Gid:    c.Gid,
+		Groups: c.Groups,
+		// Only root may change its supplementary groups, others can at best
+		// run commands as themselves.
+		NoSetGroups: os.Geteuid() != 0,
+	}
+}
+
+// env returns the given environment with the variables describing the user
+// replaced.
+func (c *Credential) env(env []string) []string {
+	replaced := map[string]string{"USER": c.User, "LOGNAME": c.User, "HOME": c.Home}
+
+	var result []string
+	for _, keyvalue := range env {
+		name := strings.SplitN(keyvalue, "=", 2)[0]
+		if _, found := replaced[name]; !found {
+			result = append(result, keyvalue)
+		}
+	}
+	for _, name := range []string{"USER", "LOGNAME", "HOME"} {
+		result = append(result, name+"="+replaced[name])
+	}
+
+	return result
+}
+
+// RetryPolicy tells when and how to retry failed commands.
+type RetryPolicy struct {
+	// Retries is how many times a failed command is run again.
+	Retries int
+	// The delay before the first retry, which doubles at each retry up to
+	// MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// On lists the exit statuses that are worth a retry. If empty, any non-zero
+	// exit status is.
+	On []int
+}
+
+// retryable reports whether the given failure is worth a retry.
+func (p *RetryPolicy) retryable(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() <= 0 {
+		// Commands that timed out, got killed or could not even start are not
+		// retried.
+		return false
+	}
+
+	if len(p.On) == 0 {
+		return true
+	}
+	for _, status := range p.On {
+		if status == exitErr.ExitCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.MinBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// RunCommand runs the given command and waits for it to complete, retrying it
+// as per its retry policy. Each attempt gets its number in ONPLUGD_ATTEMPT.
+// Failures are returned as a *CommandError.
+func (e *Executor) RunCommand(c Command) error {
+
+	cancelled, aborted := c.done()
+
+	attempts := c.Retry.Retries + 1
+	for attempt := 1; ; attempt++ {
+		if !e.acquire(c) {
+			return &CommandError{Description: c.describe(), Err: ErrCancelled}
+		}
+		err := e.runOnce(c, attempt)
+		e.release()
+		if err == nil || attempt == attempts || !c.Retry.retryable(err) {
+			return err
+		}
+
+		delay := c.Retry.backoff(attempt)
+		e.pipe.Info(fmt.Sprintf("%s (attempt %d of %d), retrying in %s",
+			err, attempt, attempts, delay))
+
+		select {
+		case <-time.After(delay):
+		case <-cancelled:
+			e.pipe.Info(fmt.Sprintf("Pending retries of %s cancelled", c.describe()))
+			return err
+		case <-aborted:
+			e.pipe.Info(fmt.Sprintf("Pending retries of %s cancelled", c.describe()))
+			return err
+		case <-e.context.Done():
+			return err
+		}
+	}
+}
+
+// stableAfter is how long a command kept running has to run for the delay
+// before its next restart to start over from the minimum.
+const stableAfter = time.Minute
+
+// KeepRunning runs the given command until its context, or its abort context,
+// is done, at which point it gets terminated. It gets restarted whenever it exits, after a delay
+// that grows as per the backoff of its retry policy while it keeps exiting
+// early. Each start gets its number in ONPLUGD_ATTEMPT. Commands kept running
+// don't count towards the maximum of running commands.
+func (e *Executor) KeepRunning(c Command) {
 
-		stdout := &pipeWriter{prefix: "STDOUT (" + prefix + "):", pipe: e.pipe}
-		stderr := &pipeWriter{prefix: "STDERR (" + prefix + "):", pipe: e.pipe}
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
+	if c.Abort == nil {
+		c.Abort = c.Context
+	}
+	_, stopped := c.done()
 
-		defer stdout.Flush()
-		defer stderr.Flush()
+	restarts := 0
+	for start := 1; ; start++ {
+		began := time.Now()
+		err := e.runOnce(c, start)
 
-		if err := cmd.Run(); err != nil {
-			e.pipe.Error(
-				fmt.Errorf("Command '%s' failed with status %s", cmdline, err))
+		select {
+		case <-stopped:
+			return
+		case <-e.context.Done():
+			return
+		default:
 		}
+
+		if time.Since(began) >= stableAfter {
+			restarts = 0
+		}
+		restarts++
+
+		delay := c.Retry.backoff(restarts)
+		if delay <= 0 {
+			delay = time.Second
+		}
+		if err != nil {
+			e.pipe.Error(fmt.Errorf("%s, restarting it in %s", err, delay))
+		} else {
+			e.pipe.Info(fmt.Sprintf("Command %s exited, restarting it in %s", c.describe(), delay))
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-stopped:
+			return
+		case <-e.context.Done():
+			return
+		}
+	}
+}
+
+// runOnce runs the given attempt at running the given command.
+func (e *Executor) runOnce(c Command, attempt int) error {
+
+	if len(c.Args) == 0 {
+		return &CommandError{Description: c.describe(), Err: errors.New("empty command")}
+	}
+
+	args := c.Args
+	if c.Script != "" {
+		script, err := writeScript(c.Script)
+		if err != nil {
+			return &CommandError{Description: c.describe(), Err: err}
+		}
+		defer os.Remove(script)
+		args = append(args[:len(args):len(args)], script)
+	}
+
+	cmd := newCmd(args)
+
+	cmd.Env = append(c.Env[:len(c.Env):len(c.Env)], fmt.Sprintf("ONPLUGD_ATTEMPT=%d", attempt))
+	if c.Credential != nil {
+		if c.Script != "" {
+			// The script is private, which makes it the user's.
+			if err := os.Chown(args[len(args)-1], int(c.Credential.Uid), int(c.Credential.Gid)); err != nil {
+				return &CommandError{Description: c.describe(), Err: err}
+			}
+		}
+		cmd.SysProcAttr.Credential = c.Credential.sys()
+		cmd.Env = c.Credential.env(cmd.Env)
+	}
+	cmd.Dir = "/"
+	if c.Dir != "" {
+		cmd.Dir = c.Dir
+	}
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	} else {
+		cmd.Stdin = nil // explicitly close stdin
+	}
+
+	if c.Script != "" {
+		e.pipe.Info(fmt.Sprintf("Executing %s", c.describe()))
+		e.pipe.Debug(fmt.Sprintf("Script: %s", c.Script))
+	} else {
+		e.pipe.Info(fmt.Sprintf("Executing '%s'", strings.Join(args, " ")))
+	}
+	e.pipe.Debug(fmt.Sprintf("Environment: %v", c.Env))
+
+	e.running.Add(1)
+	defer e.running.Done()
+
+	stdout := &pipeWriter{prefix: "STDOUT (" + c.Prefix + "):", pipe: e.pipe}
+	stderr := &pipeWriter{prefix: "STDERR (" + c.Prefix + "):", pipe: e.pipe}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	if err := e.supervise(cmd, c); err != nil {
+		return &CommandError{Description: c.describe(), Err: err}
+	}
+	return nil
+}
+
+// ErrCancelled is why a command that got cancelled before it could start
+// didn't run.
+var ErrCancelled = errors.New("was cancelled before it started")
+
+// CommandError is the error for a command that failed.
+type CommandError struct {
+	// Description describes the command.
+	Description string
+	// Err is why it failed: an *exec.ExitError, a *TimeoutError...
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	if _, timedOut := e.Err.(*TimeoutError); timedOut || e.Err == ErrCancelled {
+		return fmt.Sprintf("Command %s %s", e.Description, e.Err)
+	}
+	return fmt.Sprintf("Command %s failed with status %s", e.Description, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is the error for a command that ran out of time.
+type TimeoutError struct {
+	Timeout time.Duration
+	// Killed tells whether the command had to be killed, because it didn't
+	// terminate within the grace period.
+	Killed bool
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Killed {
+		return fmt.Sprintf("timed out after %s and had to be killed", e.Timeout)
+	}
+	return fmt.Sprintf("timed out after %s", e.Timeout)
+}
+
+// supervise runs the given command, asking its process group to terminate
+// with SIGTERM when it runs out of time or when the executor shuts down, then
+// killing it if it is still there after the grace period. It returns once the
+// command exits, but what the command leaves behind in its process group,
+// such as background jobs, remains subject to its timeout and to the shutdown
+// until it is gone.
+func (e *Executor) supervise(cmd *exec.Cmd, c Command) error {
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	result := make(chan error, 1)
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		e.superviseGroup(cmd.Process.Pid, c, done, result)
 	}()
+	return <-result
+}
+
+// groupPollInterval is how often a process group whose leader exited is
+// checked for the processes left in it.
+const groupPollInterval = 100 * time.Millisecond
+
+// superviseGroup does the supervising for supervise, of the process group with
+// the given ID. It sends the outcome of the command to result once it gets it
+// from done, then goes on until the process group is empty.
+func (e *Executor) superviseGroup(pgid int, c Command, done <-chan error, result chan<- error) {
+
+	var timeout, kill, poll <-chan time.Time
+	if c.Timeout > 0 {
+		timeout = time.After(c.Timeout)
+	}
+	cancelled := e.context.Done()
+	_, aborted := c.done()
+
+	killAfter := c.KillAfter
+	if killAfter <= 0 {
+		killAfter = DefaultKillAfter
+	}
+
+	terminate := func() {
+		signalGroup(pgid, syscall.SIGTERM)
+		if kill == nil {
+			kill = time.After(killAfter)
+		}
+	}
+
+	var timedOut *TimeoutError
+	killed := false
+	for {
+		select {
+		case err := <-done:
+			done = nil
+			if timedOut != nil {
+				timedOut.Killed = killed
+				err = timedOut
+			}
+			result <- err
+
+			if !groupAlive(pgid) {
+				return
+			}
+			e.pipe.Debug(fmt.Sprintf("%s left processes behind", c.describe()))
+			ticker := time.NewTicker(groupPollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+
+		case <-poll:
+			if !groupAlive(pgid) {
+				return
+			}
+
+		case <-timeout:
+			timeout = nil
+			if done == nil {
+				e.pipe.Info(fmt.Sprintf(
+					"Terminating what %s left behind, it timed out after %s", c.describe(), c.Timeout))
+			} else {
+				timedOut = &TimeoutError{Timeout: c.Timeout}
+			}
+			terminate()
+
+		case <-cancelled:
+			cancelled = nil
+			e.pipe.Debug(fmt.Sprintf("Terminating %s", c.describe()))
+			terminate()
+
+		case <-aborted:
+			aborted = nil
+			e.pipe.Debug(fmt.Sprintf("Terminating %s, which got cancelled", c.describe()))
+			terminate()
+
+		case <-kill:
+			kill = nil
+			killed = true
+			signalGroup(pgid, syscall.SIGKILL)
+		}
+	}
+}
+
+// newCmd prepares a command in its own process group, so that we can get rid
+// of everything it starts.
+func newCmd(args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// signalGroup sends the given signal to the process group with the given ID.
+func signalGroup(pgid int, sig syscall.Signal) {
+	// A negative pid stands for the process group.
+	syscall.Kill(-pgid, sig)
+}
+
+// groupAlive reports whether there are still processes in the process group
+// with the given ID.
+func groupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// writeScript writes the given script to a temporary file only readable by
+// us, and returns its path.
+func writeScript(script string) (string, error) {
+	f, err := os.CreateTemp("", "onplugd-script-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
 }
 
 // New returns a new executor, as well as the cleanup function to call when
-// shutting down.
+// shutting down. The cleanup function terminates the running commands and
+// waits a bounded time for them to exit.
 func New(pipe messagepipe.IMessagePipe) (*Executor, func()) {
 
 	context, cancel := context.WithCancel(context.Background())
 
-	return &Executor{
+	e := &Executor{
 		pipe:    pipe,
 		context: context,
-	}, cancel
+		slots:   make(chan struct{}, DefaultMaxRunning),
+	}
+
+	return e, func() {
+		cancel()
+
+		done := make(chan bool)
+		go func() {
+			e.running.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(shutdownTimeout):
+			e.pipe.Error(fmt.Errorf(
+				"Commands still running after %s, giving up on them", shutdownTimeout))
+		}
+	}
 }
@@ -0,0 +1,371 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"onplugd/messagepipe"
+)
+
+func Test_supervise(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		want    error
+	}{
+		{
+			name:   "success",
+			script: "true",
+		},
+		{
+			name:    "terminated",
+			script:  "exec sleep 10",
+			timeout: 100 * time.Millisecond,
+			want:    &TimeoutError{Timeout: 100 * time.Millisecond},
+		},
+		{
+			name:    "killed",
+			script:  "trap '' TERM; sleep 10",
+			timeout: 100 * time.Millisecond,
+			want:    &TimeoutError{Timeout: 100 * time.Millisecond, Killed: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Command{
+				Args:      []string{"/bin/sh", "-c", tt.script},
+				Timeout:   tt.timeout,
+				KillAfter: 100 * time.Millisecond,
+			}
+			err := e.supervise(newCmd(c.Args), c)
+
+			got, _ := err.(*TimeoutError)
+			want, _ := tt.want.(*TimeoutError)
+			if (err == nil) != (tt.want == nil) || (want != nil && (got == nil || *got != *want)) {
+				t.Errorf("supervise() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RunCommand_retry(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	fast := RetryPolicy{Retries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	tests := []struct {
+		name         string
+		script       string
+		retry        RetryPolicy
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "no retries",
+			script:       "exit 1",
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "succeeds eventually",
+			script:       `[ "$ONPLUGD_ATTEMPT" -ge 3 ] || exit 1`,
+			retry:        fast,
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up",
+			script:       "exit 1",
+			retry:        fast,
+			wantAttempts: 4,
+			wantErr:      true,
+		},
+		{
+			name:         "status not retried",
+			script:       "exit 2",
+			retry:        RetryPolicy{Retries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, On: []int{1}},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := path.Join(t.TempDir(), "attempts")
+			err := e.RunCommand(Command{
+				Args:  []string{"/bin/sh", "-c", "echo >>" + log + "; " + tt.script},
+				Retry: tt.retry,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RunCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			content, _ := os.ReadFile(log)
+			if attempts := strings.Count(string(content), "\n"); attempts != tt.wantAttempts {
+				t.Errorf("RunCommand() ran %d time(s), want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func Test_RunCommand_cancel(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	ctx, cancelRetries := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancelRetries)
+
+	start := time.Now()
+	err := e.RunCommand(Command{
+		Args:    []string{"/bin/sh", "-c", "exit 1"},
+		Retry:   RetryPolicy{Retries: 3, MinBackoff: time.Minute, MaxBackoff: time.Minute},
+		Context: ctx,
+	})
+	if err == nil || time.Since(start) > 10*time.Second {
+		t.Errorf("RunCommand() error = %v after %s, want a failure once cancelled",
+			err, time.Since(start))
+	}
+}
+
+func Test_RunCommand_abort(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	// Cancelling only cancels the retries, aborting terminates the command.
+	ctx, cancelRetries := context.WithCancel(context.Background())
+	abort, abortCommand := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancelRetries)
+	time.AfterFunc(300*time.Millisecond, abortCommand)
+
+	start := time.Now()
+	err := e.RunCommand(Command{
+		Args:    []string{"/bin/sh", "-c", "exec sleep 10"},
+		Context: ctx,
+		Abort:   abort,
+	})
+	if elapsed := time.Since(start); err == nil || elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("RunCommand() error = %v after %s, want a termination once aborted", err, elapsed)
+	}
+}
+
+func Test_RetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func Test_RunCommand_credential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running commands as another user requires root")
+	}
+
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	dir := t.TempDir()
+	for _, d := range []string{dir, path.Dir(dir)} {
+		if err := os.Chmod(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := path.Join(dir, "out")
+
+	err := e.RunCommand(Command{
+		Args:   []string{"/bin/sh"},
+		Script: `echo "$(id -u):$(id -g):$(id -G):$USER:$HOME" >` + out,
+		Env:    []string{"PATH=" + os.Getenv("PATH"), "USER=root", "HOME=/root"},
+		Credential: &Credential{
+			Uid: 65534, Gid: 65534, Groups: []uint32{65534}, User: "nobody", Home: "/nonexistent"},
+	})
+	if err != nil {
+		t.Fatalf("RunCommand() error = %v", err)
+	}
+
+	content, _ := os.ReadFile(out)
+	if got, want := strings.TrimSpace(string(content)), "65534:65534:65534:nobody:/nonexistent"; got != want {
+		t.Errorf("RunCommand() ran as %q, want %q", got, want)
+	}
+}
+
+func Test_SetMaxRunning(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+	e.SetMaxRunning(1)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.RunCommand(Command{Args: []string{"/bin/sh", "-c", "sleep 0.2"}})
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("2 commands of 200ms ran in %s with 1 at a time", elapsed)
+	}
+}
+
+func Test_KeepRunning(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cancel := New(&pipe)
+	defer cancel()
+
+	tests := []struct {
+		name      string
+		script    string
+		minStarts int
+		maxStarts int
+	}{
+		{name: "restarted", script: "exit 1", minStarts: 3, maxStarts: 20},
+		{name: "terminated", script: "exec sleep 10", minStarts: 1, maxStarts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := path.Join(t.TempDir(), "starts")
+			ctx, stop := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, stop)
+
+			start := time.Now()
+			e.KeepRunning(Command{
+				Args:    []string{"/bin/sh", "-c", "echo >>" + log + "; " + tt.script},
+				Retry:   RetryPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+				Context: ctx,
+			})
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("KeepRunning() returned %s after being stopped", elapsed)
+			}
+
+			content, _ := os.ReadFile(log)
+			if starts := strings.Count(string(content), "\n"); starts < tt.minStarts || starts > tt.maxStarts {
+				t.Errorf("KeepRunning() started %d time(s), want %d to %d",
+					starts, tt.minStarts, tt.maxStarts)
+			}
+		})
+	}
+}
+
+func Test_shutdown(t *testing.T) {
+	pipe := messagepipe.New(false)
+	e, cleanup := New(&pipe)
+
+	// A background job, that used to survive its shell.
+	pidFile := path.Join(t.TempDir(), "pid")
+	go e.RunCommand(Command{
+		Args: []string{"/bin/sh", "-c", "sleep 30 & echo $! > " + pidFile + "; wait"},
+	})
+
+	var pid int
+	for start := time.Now(); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("the command did not start")
+		}
+		content, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+
+	start := time.Now()
+	cleanup()
+	if elapsed := time.Since(start); elapsed > DefaultKillAfter {
+		t.Errorf("cleanup took %s", elapsed)
+	}
+
+	// The job may take a moment to die, and may linger as a zombie if nobody
+	// reaps it.
+	for start := time.Now(); alive(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("background job %d survived the shutdown", pid)
+		}
+	}
+}
+
+func Test_supervise_leftovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		timeout  time.Duration
+		shutdown bool
+	}{
+		{
+			name:    "timeout",
+			script:  "sleep 30",
+			timeout: 200 * time.Millisecond,
+		},
+		{
+			name:    "timeout ignored",
+			script:  "trap '' TERM; sleep 30",
+			timeout: 200 * time.Millisecond,
+		},
+		{
+			name:     "shutdown",
+			script:   "sleep 30",
+			shutdown: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipe := messagepipe.New(false)
+			e, cleanup := New(&pipe)
+			defer cleanup()
+
+			// A background job, that outlives its shell.
+			pidFile := path.Join(t.TempDir(), "pid")
+			c := Command{
+				Args: []string{"/bin/sh", "-c",
+					"(" + tt.script + ") >/dev/null 2>&1 & echo $! > " + pidFile},
+				Timeout:   tt.timeout,
+				KillAfter: 100 * time.Millisecond,
+			}
+			if err := e.supervise(newCmd(c.Args), c); err != nil {
+				t.Fatalf("supervise() error = %v", err)
+			}
+
+			content, _ := os.ReadFile(pidFile)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+			if !alive(pid) {
+				t.Fatalf("background job %d did not outlive its shell", pid)
+			}
+
+			if tt.shutdown {
+				cleanup()
+			}
+			for start := time.Now(); alive(pid); time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > time.Second {
+					t.Fatalf("background job %d survived", pid)
+				}
+			}
+		})
+	}
+}
+
+func alive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state comes after the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
@@ -3,6 +3,7 @@ module onplugd
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/jochenvg/go-udev v0.0.0-20171110120927-d6b62d56d37b
 	golang.org/x/sys v0.9.0
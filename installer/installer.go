@@ -0,0 +1,166 @@
+package installer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"onplugd/utils"
+)
+
+// Mode selects how onplugd gets installed.
+type Mode uint8
+
+const (
+	// User installs onplugd as a systemd user service.
+	User Mode = iota
+	// System installs onplugd as a systemd system service.
+	System
+)
+
+const unitName = "onplugd.service"
+
+const systemUnitDir = "/etc/systemd/system"
+
+// Installer writes and removes the systemd unit that runs onplugd.
+type Installer struct {
+	mode       Mode
+	root       string
+	executable string
+	configDir  string
+}
+
+// New creates a new Installer for the given mode. The unit will run the given
+// executable against the given config directories, and all the files will be
+// written relative to the given root directory.
+func New(mode Mode, root string, executable string, configDir string) Installer {
+	return Installer{
+		mode:       mode,
+		root:       root,
+		executable: executable,
+		configDir:  configDir,
+	}
+}
+
+// UnitPath returns the path where the unit file gets installed.
+func (i Installer) UnitPath() string {
+	if i.mode == System {
+		return path.Join(i.root, systemUnitDir, unitName)
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = utils.Expand("~/.config")
+	}
+
+	return path.Join(i.root, configHome, "systemd", "user", unitName)
+}
+
+// Unit returns the content of the unit file.
+func (i Installer) Unit() string {
+
+	return fmt.Sprintf(`[Unit]
+Description=Run commands when devices get plugged
+Documentation=https://github.com/pvaret/onplugd
+
+[Service]
+Type=simple
+ExecStart=%s %s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=%s
+`,
+		quote(i.executable), quote("--config_dir="+i.configDir), i.wantedBy())
+}
+
+// Install writes the unit file, and in system mode creates the config
+// directories.
+func (i Installer) Install() error {
+
+	if i.mode == System {
+		for _, dir := range strings.Split(i.configDir, ":") {
+			configDir := path.Join(i.root, dir)
+			err := os.MkdirAll(configDir, 0755)
+			if err != nil {
+				return err
+			}
+
+			// MkdirAll is subject to the umask and leaves existing directories
+			// alone, so enforce the permissions explicitly: only the owner may
+			// add configs, since they run commands.
+			err = os.Chmod(configDir, 0755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	unitPath := i.UnitPath()
+
+	err := os.MkdirAll(path.Dir(unitPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(unitPath, []byte(i.Unit()), 0644)
+}
+
+// Uninstall removes the unit file, and the link that enables it if any. The
+// config directory is left alone.
+func (i Installer) Uninstall() error {
+
+	wants := path.Join(
+		path.Dir(i.UnitPath()), i.wantedBy()+".wants", unitName)
+	err := os.Remove(wants)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(i.UnitPath())
+}
+
+// InstallHint returns the systemctl command line that enables the installed
+// unit.
+func (i Installer) InstallHint() string {
+	return fmt.Sprintf("%s daemon-reload && %s enable --now %s",
+		i.systemctl(), i.systemctl(), unitName)
+}
+
+// UninstallHint returns the systemctl command line that stops the uninstalled
+// unit.
+func (i Installer) UninstallHint() string {
+	return fmt.Sprintf("%s stop %s && %s daemon-reload",
+		i.systemctl(), unitName, i.systemctl())
+}
+
+func (i Installer) wantedBy() string {
+	if i.mode == System {
+		return "multi-user.target"
+	}
+	return "default.target"
+}
+
+func (i Installer) systemctl() string {
+	if i.mode == User {
+		return "systemctl --user"
+	}
+	return "systemctl"
+}
+
+// quote quotes a command line argument for systemd, if needed.
+func quote(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"'\\$%") {
+		return arg
+	}
+
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	arg = strings.ReplaceAll(arg, "%", "%%")
+
+	return `"` + arg + `"`
+}
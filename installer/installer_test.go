@@ -0,0 +1,107 @@
+package installer
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"onplugd/confmonitor"
+)
+
+func Test_quote(t *testing.T) {
+	type args struct {
+		arg string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "plain",
+			args: args{arg: "/usr/bin/onplugd"},
+			want: "/usr/bin/onplugd",
+		},
+		{
+			name: "space",
+			args: args{arg: "--config_dir=/home/a b/conf"},
+			want: `"--config_dir=/home/a b/conf"`,
+		},
+		{
+			name: "specifiers",
+			args: args{arg: `a"$HOME%h`},
+			want: `"a\"$$HOME%%h"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quote(tt.args.arg); got != tt.want {
+				t.Errorf("quote() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InstallSystem(t *testing.T) {
+	root := t.TempDir()
+	i := New(System, root, "/usr/bin/onplugd", confmonitor.SystemConfigDir)
+
+	if err := i.Install(); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+
+	unit, err := os.ReadFile(path.Join(root, "etc/systemd/system/onplugd.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"ExecStart=/usr/bin/onplugd --config_dir=/etc/onplugd.d\n",
+		"ExecReload=/bin/kill -HUP $MAINPID\n",
+		"Restart=on-failure\n",
+		"WantedBy=multi-user.target\n",
+	} {
+		if !strings.Contains(string(unit), want) {
+			t.Errorf("unit file lacks %q:\n%s", want, unit)
+		}
+	}
+
+	info, err := os.Stat(path.Join(root, confmonitor.SystemConfigDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("config dir permissions = %v, want %v", info.Mode().Perm(), 0755)
+	}
+
+	if err := i.Uninstall(); err != nil {
+		t.Fatalf("Uninstall() error = %v", err)
+	}
+	if _, err := os.Stat(i.UnitPath()); !os.IsNotExist(err) {
+		t.Errorf("unit file still there after Uninstall()")
+	}
+}
+
+func Test_InstallUser(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", "/home/test/.config")
+	i := New(User, root, "/usr/bin/onplugd", "/home/test/.config/onplugd.d")
+
+	if err := i.Install(); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+
+	want := path.Join(root, "/home/test/.config/systemd/user/onplugd.service")
+	if i.UnitPath() != want {
+		t.Errorf("UnitPath() = %v, want %v", i.UnitPath(), want)
+	}
+
+	unit, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "WantedBy=default.target\n") {
+		t.Errorf("unit file is not a user unit:\n%s", unit)
+	}
+}
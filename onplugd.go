@@ -2,18 +2,26 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 
+	"onplugd/action"
 	"onplugd/actionregistry"
 	"onplugd/confmonitor"
+	"onplugd/device"
+	"onplugd/deviceevent"
 	"onplugd/devicemonitor"
 	"onplugd/engine"
 	"onplugd/executor"
+	"onplugd/installer"
 	"onplugd/messagepipe"
 	"onplugd/utils"
+	"onplugd/wizard"
 )
 
 // MainLoop is a type that describes a main loop: a function that starts the
@@ -21,8 +29,8 @@ import (
 // main loop.
 type MainLoop func() (func() error, error)
 
-// RunWithSignals wraps a main loop in a handler that can deal with SIGINT and
-// SIGHUP signals.
+// RunWithSignals wraps a main loop in a handler that can deal with SIGINT,
+// SIGTERM and SIGHUP signals.
 func RunWithSignals(loop MainLoop) error {
 
 	for done := false; !done; {
@@ -32,7 +40,7 @@ func RunWithSignals(loop MainLoop) error {
 		}
 
 		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT)
+		signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 		s := <-sig
 		switch s {
@@ -41,6 +49,9 @@ func RunWithSignals(loop MainLoop) error {
 		case syscall.SIGINT:
 			log.Println("SIGINT received, quitting...")
 			done = true
+		case syscall.SIGTERM:
+			log.Println("SIGTERM received, quitting...")
+			done = true
 		default:
 			log.Println("Unexpected signal received:", s)
 			done = true
@@ -56,13 +67,23 @@ func RunWithSignals(loop MainLoop) error {
 	return nil
 }
 
-func mainLoop(configDir string, debug bool) (func() error, error) {
+func mainLoop(configDirs []string, debug bool, maxRunning int) (func() error, error) {
 
 	messagePipe := messagepipe.New(debug)
 	deviceMonitor := devicemonitor.New(&messagePipe)
 	executor, cleanup := executor.New(&messagePipe)
+	executor.SetMaxRunning(maxRunning)
 	actionRegistry := actionregistry.New(&messagePipe, executor)
-	confMonitor := confmonitor.New(configDir, &messagePipe)
+	confMonitor := confmonitor.New(configDirs, &messagePipe)
+	confMonitor.SetPatterns(action.Patterns())
+	// All configs depend on the shared variables, wherever they are.
+	confMonitor.SetDependencies(func(fullpath string) []string {
+		deps := action.Dependencies(fullpath)
+		if vars := confMonitor.Lookup(action.VarsFile); vars != "" {
+			deps = append(deps, vars)
+		}
+		return deps
+	})
 
 	e := engine.New(&deviceMonitor, &confMonitor, actionRegistry, &messagePipe)
 	e.AddCleanupCallback(cleanup)
@@ -75,27 +96,335 @@ func mainLoop(configDir string, debug bool) (func() error, error) {
 	return e.Stop, nil
 }
 
+func runWizard(configDir string, debug bool) error {
+
+	messagePipe := messagepipe.New(debug)
+	deviceMonitor := devicemonitor.New(&messagePipe)
+
+	_, err := wizard.New(
+		configDir, &deviceMonitor, &messagePipe, os.Stdin, os.Stdout).Run()
+	return err
+}
+
+func runInstaller(
+	uninstall bool, mode installer.Mode, root string, configDirs []string) error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+
+	for n, dir := range configDirs {
+		configDirs[n], err = filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	i := installer.New(mode, root, executable, strings.Join(configDirs, ":"))
+
+	if uninstall {
+		err = i.Uninstall()
+		if err != nil {
+			return err
+		}
+		log.Println("Removed", i.UnitPath())
+		log.Println("Now run:", i.UninstallHint())
+		return nil
+	}
+
+	err = i.Install()
+	if err != nil {
+		return err
+	}
+	log.Println("Wrote", i.UnitPath())
+	log.Println("Now run:", i.InstallHint())
+	return nil
+}
+
+// runExplain implements the "explain" command, which details how the actions
+// of a config fare against a live or recorded device. It reports whether any
+// of them matched.
+func runExplain(args []string, configDirs []string) (bool, error) {
+
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	event := flags.String("event", string(deviceevent.Add),
+		"The device event to check the config against")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s explain [-event EVENT] <conf> <devpath|dump file>\n",
+			os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	vars, err := action.LoadVars(confmonitor.Lookup(configDirs, action.VarsFile))
+	if err != nil {
+		return false, err
+	}
+
+	actions, err := action.NewActionsFromFile(flags.Arg(0), vars)
+	if err != nil {
+		return false, err
+	}
+
+	var d device.IDevice
+	if info, err := os.Stat(flags.Arg(1)); err == nil && info.Mode().IsRegular() {
+		dump, err := os.ReadFile(flags.Arg(1))
+		if err != nil {
+			return false, err
+		}
+		d, err = device.Parse(string(dump))
+		if err != nil {
+			return false, err
+		}
+	} else {
+		d, err = devicemonitor.Lookup(flags.Arg(1))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	e := deviceevent.New(deviceevent.Event(strings.ToUpper(*event)), d)
+	fmt.Println(e)
+
+	matched := false
+	for _, a := range actions {
+		trace := a.Explain(e)
+		fmt.Println(trace)
+		matched = matched || trace.Matched()
+	}
+
+	return matched, nil
+}
+
+// runLint implements the "lint" command, which checks the config files found
+// in the given directories and their subdirectories, or the given files. It
+// reports whether the configs passed.
+func runLint(args []string, configDirs []string) (bool, error) {
+
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := flags.Bool("strict", false, "Fail on warnings too")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s lint [-strict] [dir|conf]...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	targets := flags.Args()
+	if len(targets) == 0 {
+		for _, dir := range configDirs {
+			if _, err := os.Stat(dir); err == nil {
+				targets = append(targets, dir)
+			}
+		}
+	}
+
+	var files []string
+	for _, target := range targets {
+		info, err := os.Stat(target)
+		if err != nil {
+			return false, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, target)
+			continue
+		}
+
+		err = filepath.Walk(target,
+			func(fullpath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && isConf(fullpath) {
+					files = append(files, fullpath)
+				}
+				return nil
+			})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	errors, warnings := 0, 0
+
+	varsPath := confmonitor.Lookup(configDirs, action.VarsFile)
+	vars, err := action.LoadVars(varsPath)
+	if err != nil {
+		fmt.Println(err)
+		errors++
+	}
+
+	for _, f := range files {
+		// Masks are empty on purpose.
+		if confmonitor.IsMask(f) {
+			continue
+		}
+
+		if filepath.Base(f) == action.VarsFile {
+			if f == varsPath {
+				continue
+			}
+			if _, err := action.LoadVars(f); err != nil {
+				fmt.Println(err)
+				errors++
+			}
+			continue
+		}
+
+		for _, d := range action.Lint(f, vars) {
+			fmt.Println(d)
+			if d.Severity == action.Error {
+				errors++
+			} else {
+				warnings++
+			}
+		}
+	}
+
+	fmt.Printf("%d file(s) checked: %d error(s), %d warning(s)\n",
+		len(files), errors, warnings)
+
+	return errors == 0 && (warnings == 0 || !*strict), nil
+}
+
+// isConf reports whether the given path has the name of a config file.
+func isConf(fullpath string) bool {
+	for _, pattern := range action.Patterns() {
+		if matching, _ := filepath.Match(pattern, filepath.Base(fullpath)); matching {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 
-	configDirFlag := flag.String("config_dir", "~/.config/onplugd.d/",
-		"The directory where configs are stored")
+	configDirFlag := flag.String("config_dir",
+		strings.Join(confmonitor.DefaultSearchPath(), ":"),
+		"The directories where configs are stored, separated by ':', from "+
+			"lowest to highest precedence")
 	debug := flag.Bool("debug", false, "Log more verbosely")
+	maxRunning := flag.Int("max_running", executor.DefaultMaxRunning,
+		"How many commands may run at the same time, the others waiting for their turn")
+	wizardMode := flag.Bool("wizard", false,
+		"Generate a config for the next device that gets plugged in")
+	install := flag.Bool("install", false,
+		"Install onplugd as a systemd service")
+	uninstall := flag.Bool("uninstall", false,
+		"Uninstall the onplugd systemd service")
+	userMode := flag.Bool("user", false,
+		"With --install or --uninstall, use a systemd user service (default)")
+	systemMode := flag.Bool("system", false,
+		"With --install or --uninstall, use a systemd system service")
+	root := flag.String("root", "/",
+		"With --install or --uninstall, the root directory to install into")
 	flag.Parse()
 
-	configDir := utils.Expand(*configDirFlag)
+	var configDirs []string
+	for _, dir := range strings.Split(*configDirFlag, ":") {
+		if dir != "" {
+			configDirs = append(configDirs, utils.Expand(dir))
+		}
+	}
+	if len(configDirs) == 0 {
+		log.Fatal("No config directory given")
+	}
+	if *maxRunning < 1 {
+		log.Fatal("--max_running must be at least 1")
+	}
+
+	if flag.Arg(0) == "explain" {
+		matched, err := runExplain(flag.Args()[1:], configDirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !matched {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "lint" {
+		passed, err := runLint(flag.Args()[1:], configDirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *install || *uninstall {
+		if *install && *uninstall {
+			log.Fatal("--install and --uninstall are mutually exclusive")
+		}
+		if *userMode && *systemMode {
+			log.Fatal("--user and --system are mutually exclusive")
+		}
+
+		mode := installer.User
+		if *systemMode {
+			mode = installer.System
+
+			// Unless told otherwise, the system service doesn't read configs
+			// from root's home.
+			if !isFlagSet("config_dir") {
+				configDirs = []string{confmonitor.SystemConfigDir}
+			}
+		}
+
+		err := runInstaller(*uninstall, mode, *root, configDirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if *debug {
 		log.Println("Debug on.")
-		log.Println("Config directory:", configDir)
+		log.Println("Config directories:", strings.Join(configDirs, ", "))
+	}
+
+	if *wizardMode {
+		// New configs go to the user's directory.
+		err := runWizard(configDirs[len(configDirs)-1], *debug)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	log.Println("Started with PID", os.Getpid())
 
 	err := RunWithSignals(func() (func() error, error) {
-		return mainLoop(configDir, *debug)
+		return mainLoop(configDirs, *debug, *maxRunning)
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 }
+
+// isFlagSet reports whether the given flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
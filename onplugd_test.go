@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_runLintMasks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "empty.conf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(os.DevNull, path.Join(dir, "null.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	passed, err := runLint([]string{dir}, []string{dir})
+	if err != nil || !passed {
+		t.Errorf("runLint() = %v, %v, want masks to pass", passed, err)
+	}
+
+	// A config with nothing useful in it is still an error.
+	if err := os.WriteFile(path.Join(dir, "comment.conf"), []byte("# nothing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if passed, _ := runLint([]string{dir}, []string{dir}); passed {
+		t.Errorf("runLint() passed a config without any action")
+	}
+}
@@ -47,15 +47,68 @@ func getHomeDir() string {
 	return u.HomeDir
 }
 
-// Expand expands the "~" in a path.
+// Expand expands a leading "~" or "~user" in a path. Paths referring to
+// unknown users are returned unchanged.
 func Expand(path string) string {
-	home := strings.TrimSuffix(getHomeDir(), "/")
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+
+	name, rest := path[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
 
-	if path == "~" || strings.HasPrefix(path, "~/") {
-		return home + strings.TrimPrefix(path, "~")
+	var home string
+	if name == "" {
+		home = getHomeDir()
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return path
+		}
+		home = u.HomeDir
 	}
 
-	return path
+	return strings.TrimSuffix(home, "/") + rest
+}
+
+// EditDistance returns the Levenshtein distance between two strings, i.e. the
+// number of single character edits needed to turn one into the other.
+func EditDistance(s1, s2 string) int {
+	r1, r2 := []rune(s1), []rune(s2)
+
+	// Only keep the previous row of the distance matrix around.
+	row := make([]int, len(r2)+1)
+	for j := range row {
+		row[j] = j
+	}
+
+	for i := 1; i <= len(r1); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(r2); j++ {
+			cost := 1
+			if r1[i-1] == r2[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diagonal+cost)
+			diagonal = row[j]
+			row[j] = next
+		}
+	}
+
+	return row[len(r2)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
 }
 
 // IsATerminal determines if the given file is a TTY.
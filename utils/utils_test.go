@@ -82,6 +82,16 @@ func Test_Expand(t *testing.T) {
 			args: args{path: "~/test"},
 			want: "/home/test/test",
 		},
+		{
+			name: "user",
+			args: args{path: "~root/test"},
+			want: "/root/test",
+		},
+		{
+			name: "unknown user",
+			args: args{path: "~nosuchuser/test"},
+			want: "~nosuchuser/test",
+		},
 		{
 			name: "no change",
 			args: args{path: "/a/b/c"},
@@ -97,6 +107,46 @@ func Test_Expand(t *testing.T) {
 	}
 }
 
+func Test_EditDistance(t *testing.T) {
+	type args struct {
+		s1 string
+		s2 string
+	}
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{
+			name: "empty",
+			args: args{s1: "", s2: "abc"},
+			want: 3,
+		},
+		{
+			name: "same",
+			args: args{s1: "match", s2: "match"},
+			want: 0,
+		},
+		{
+			name: "deletion",
+			args: args{s1: "matc", s2: "match"},
+			want: 1,
+		},
+		{
+			name: "transposition",
+			args: args{s1: "subsytsem", s2: "subsystem"},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EditDistance(tt.args.s1, tt.args.s2); got != tt.want {
+				t.Errorf("EditDistance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	os.Setenv("HOME", testHome)
 	os.Exit(m.Run())
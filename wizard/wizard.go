@@ -0,0 +1,329 @@
+package wizard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"onplugd/action"
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/devicemonitor"
+	"onplugd/messagepipe"
+)
+
+// How long to keep collecting device events after the first one, since
+// plugging a single physical device usually triggers a burst of them (the
+// device itself, its interfaces, the input devices they expose...).
+const settleDelay = 2 * time.Second
+
+// The device attributes that make for stable identifiers, from most to least
+// specific. The USB attributes are listed first since they identify the
+// physical device; "name" is what input devices expose instead.
+var identifierAttrs = []string{"idVendor", "idProduct", "serial", "product", "name"}
+
+// Wizard generates a config for the next device that gets plugged in.
+type Wizard struct {
+	configDir string
+	monitor   devicemonitor.IDeviceMonitor
+	pipe      messagepipe.IMessagePipe
+	in        *bufio.Reader
+	out       io.Writer
+
+	lock    sync.Mutex
+	devices []device.IDevice
+	plugged chan bool
+}
+
+// New creates a new Wizard that will write its config into the given
+// directory, reading the user's answers from in and writing its questions to
+// out.
+func New(
+	configDir string, monitor devicemonitor.IDeviceMonitor,
+	pipe messagepipe.IMessagePipe, in io.Reader, out io.Writer) *Wizard {
+
+	w := Wizard{
+		configDir: configDir,
+		monitor:   monitor,
+		pipe:      pipe,
+		in:        bufio.NewReader(in),
+		out:       out,
+		plugged:   make(chan bool, 1),
+	}
+
+	monitor.AddCallback(w.onDeviceEvent)
+
+	return &w
+}
+
+// Run waits for a device to be plugged, asks the user how to handle it, and
+// writes the resulting config file. It returns the path of that file.
+func (w *Wizard) Run() (string, error) {
+
+	fmt.Fprintln(w.out, "Plug the device in now (Ctrl-C to abort)...")
+
+	err := w.monitor.Start()
+	if err != nil {
+		return "", err
+	}
+
+	<-w.plugged
+	time.Sleep(settleDelay)
+	w.monitor.Stop()
+
+	w.lock.Lock()
+	devices := w.devices
+	w.lock.Unlock()
+
+	d, err := w.chooseDevice(devices)
+	if err != nil {
+		return "", err
+	}
+
+	match := suggestMatch(d)
+	fmt.Fprintln(w.out, "Suggested [match] section:")
+	for _, m := range match {
+		fmt.Fprintf(w.out, "  %s = %s\n", m.key, m.value)
+	}
+
+	cmdline, err := w.ask("Command to run when the device is plugged in", "")
+	if err != nil {
+		return "", err
+	}
+	if cmdline == "" {
+		return "", errors.New("No command given, not writing any config")
+	}
+
+	name, err := w.ask("Config file name", suggestFileName(d))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(name, ".conf") {
+		name += ".conf"
+	}
+
+	fullpath := path.Join(w.configDir, path.Base(name))
+
+	err = os.MkdirAll(w.configDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// O_EXCL so we never clobber an existing config.
+	f, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.WriteString(renderConf(d, match, cmdline))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Make sure the daemon will take it.
+		_, err = action.NewActionsFromFile(fullpath, nil)
+	}
+	if err != nil {
+		os.Remove(fullpath)
+		return "", err
+	}
+
+	fmt.Fprintln(w.out, "Wrote", fullpath)
+
+	return fullpath, nil
+}
+
+// onDeviceEvent collects the devices that get plugged while the wizard runs.
+func (w *Wizard) onDeviceEvent(event deviceevent.IDeviceEvent) error {
+
+	// Coldplug events are for the devices that were already there.
+	if event.Event() != deviceevent.Add {
+		return nil
+	}
+
+	w.pipe.Debug(fmt.Sprint("Wizard: device added: ", event.Device()))
+
+	w.lock.Lock()
+	w.devices = append(w.devices, event.Device())
+	w.lock.Unlock()
+
+	select {
+	case w.plugged <- true:
+	default:
+	}
+
+	return nil
+}
+
+// chooseDevice lists the given devices and lets the user pick one. The device
+// with the most identifiers is offered as the default.
+func (w *Wizard) chooseDevice(devices []device.IDevice) (device.IDevice, error) {
+
+	if len(devices) == 0 {
+		return nil, errors.New("No device detected")
+	}
+
+	best := 0
+	for i, d := range devices {
+		if score(d) > score(devices[best]) {
+			best = i
+		}
+	}
+
+	fmt.Fprintf(w.out, "Detected %d device(s):\n", len(devices))
+	for i, d := range devices {
+		fmt.Fprintf(w.out, "  %d) %s\n", i+1, d)
+
+		var ids []string
+		for _, attr := range identifierAttrs {
+			if value := strings.TrimSpace(d.Attrs()[attr]); value != "" {
+				ids = append(ids, attr+"="+value)
+			}
+		}
+		if len(ids) > 0 {
+			fmt.Fprintf(w.out, "     %s\n", strings.Join(ids, " "))
+		}
+	}
+
+	for {
+		answer, err := w.ask("Device to match", strconv.Itoa(best+1))
+		if err != nil {
+			return nil, err
+		}
+
+		i, err := strconv.Atoi(answer)
+		if err == nil && i >= 1 && i <= len(devices) {
+			return devices[i-1], nil
+		}
+
+		fmt.Fprintf(w.out, "Please enter a number between 1 and %d.\n", len(devices))
+	}
+}
+
+// ask prompts the user with the given question and returns their answer, or
+// the given default if the answer is empty.
+func (w *Wizard) ask(question string, def string) (string, error) {
+
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+
+	answer, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", err
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		answer = def
+	}
+
+	return answer, nil
+}
+
+// matchEntry is a key/value line of a [match] section.
+type matchEntry struct {
+	key   string
+	value string
+}
+
+// score rates how well the given device can be identified.
+func score(d device.IDevice) int {
+	s := 0
+	for _, attr := range identifierAttrs {
+		if strings.TrimSpace(d.Attrs()[attr]) != "" {
+			s++
+		}
+	}
+	return s
+}
+
+// suggestMatch returns the [match] entries that identify the given device.
+func suggestMatch(d device.IDevice) []matchEntry {
+
+	match := []matchEntry{{key: "subsystem", value: d.Subsystem()}}
+
+	if d.Type() != "" {
+		match = append(match, matchEntry{key: "type", value: d.Type()})
+	}
+
+	for _, attr := range identifierAttrs {
+		if value := strings.TrimSpace(d.Attrs()[attr]); value != "" {
+			match = append(match, matchEntry{key: "attr", value: attr + "=" + value})
+		}
+	}
+
+	return match
+}
+
+var nonAlnum = regexp.MustCompile("[^a-z0-9]+")
+
+// suggestFileName derives a config file name from the device's name.
+func suggestFileName(d device.IDevice) string {
+
+	for _, attr := range []string{"product", "name"} {
+		name := nonAlnum.ReplaceAllString(strings.ToLower(d.Attrs()[attr]), "-")
+		name = strings.Trim(name, "-")
+		if name != "" {
+			return name + ".conf"
+		}
+	}
+
+	return "device.conf"
+}
+
+// renderConf returns the content of a config file that runs the given command
+// line when a device matching the given entries is plugged in.
+func renderConf(d device.IDevice, match []matchEntry, cmdline string) string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Generated by onplugd --wizard for:\n#   %s\n\n", d)
+
+	b.WriteString("[match]\n")
+	for _, m := range match {
+		fmt.Fprintf(&b, "%s = %s\n", m.key, quote(escapeVars.Replace(m.value)))
+	}
+
+	b.WriteString("\n[action]\n")
+	fmt.Fprintf(&b, "exec = %s\n", quote(escapeCommand.Replace(cmdline)))
+
+	return b.String()
+}
+
+// escapeVars keeps the ${NAME} in a value from being expanded as a variable.
+var escapeVars = strings.NewReplacer("${", "$${")
+
+// escapeCommand keeps the ${NAME} and {{...}} in a command line from being
+// expanded as a variable or as a command line template, leaving them to the
+// shell.
+var escapeCommand = strings.NewReplacer("${", "$${", "{{", `{{raw "{{"}}`)
+
+// quote protects a value from the INI parser if needed, i.e. if it contains
+// comment characters, ends with a line continuation or is wrapped in quotes.
+func quote(value string) string {
+
+	if !strings.ContainsAny(value, "#;\n") &&
+		!strings.HasSuffix(value, "\\") &&
+		!strings.HasPrefix(value, "\"") &&
+		!strings.HasPrefix(value, "'") &&
+		!strings.HasPrefix(value, "`") {
+		return value
+	}
+
+	if !strings.Contains(value, "`") {
+		return "`" + value + "`"
+	}
+
+	return `"""` + value + `"""`
+}
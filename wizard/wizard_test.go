@@ -0,0 +1,116 @@
+package wizard
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"onplugd/action"
+	"onplugd/device"
+	"onplugd/deviceevent"
+	"onplugd/executor"
+)
+
+func Test_quote(t *testing.T) {
+	type args struct {
+		value string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "plain",
+			args: args{value: "xset r rate 200 30"},
+			want: "xset r rate 200 30",
+		},
+		{
+			name: "comment",
+			args: args{value: "echo a; echo b"},
+			want: "`echo a; echo b`",
+		},
+		{
+			name: "quoted",
+			args: args{value: "\"a\""},
+			want: "`\"a\"`",
+		},
+		{
+			name: "backtick",
+			args: args{value: "echo `date`; true"},
+			want: "\"\"\"echo `date`; true\"\"\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quote(tt.args.value); got != tt.want {
+				t.Errorf("quote() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_renderConf(t *testing.T) {
+	d := device.New("/devices/pci0000:00/usb1/1-2")
+	d.SetSubsystem("usb")
+	d.SetType("usb_device")
+	d.Attrs()["idVendor"] = "046d"
+	d.Attrs()["idProduct"] = "c52b"
+	d.Attrs()["product"] = "USB Receiver"
+
+	if got := suggestFileName(d); got != "usb-receiver.conf" {
+		t.Errorf("suggestFileName() = %v, want %v", got, "usb-receiver.conf")
+	}
+
+	fullpath := path.Join(t.TempDir(), "test.conf")
+	d.Attrs()["serial"] = "${SERIAL}"
+
+	// Left to the shell, literally.
+	cmdline := `echo plugged; echo # "${HOME}" {{.Event}}`
+	conf := renderConf(d, suggestMatch(d), cmdline)
+	err := os.WriteFile(fullpath, []byte(conf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := action.NewActionsFromFile(fullpath, nil)
+	if err != nil {
+		t.Fatalf("NewActionsFromFile() error = %v", err)
+	}
+	a := actions[0]
+
+	if !a.Match(deviceevent.New(deviceevent.Add, d)) {
+		t.Errorf("generated config does not match its device:\n%s", conf)
+	}
+
+	ex := &fakeExecutor{}
+	if err := a.Do(context.Background(), deviceevent.New(deviceevent.Add, d), ex); err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if len(ex.ran) != 1 || ex.ran[0] != cmdline {
+		t.Errorf("Do() ran %q, want %q", ex.ran, cmdline)
+	}
+
+	other := device.New("/devices/pci0000:00/usb1/1-3")
+	other.SetSubsystem("usb")
+	other.SetType("usb_device")
+	other.Attrs()["idVendor"] = "046d"
+	other.Attrs()["idProduct"] = "c077"
+
+	if a.Match(deviceevent.New(deviceevent.Add, other)) {
+		t.Errorf("generated config matches another device:\n%s", conf)
+	}
+}
+
+// fakeExecutor records the command lines it gets.
+type fakeExecutor struct {
+	ran []string
+}
+
+func (e *fakeExecutor) RunCommand(c executor.Command) error {
+	e.ran = append(e.ran, c.Args[len(c.Args)-1])
+	return nil
+}
+
+func (e *fakeExecutor) KeepRunning(c executor.Command) {}